@@ -14,216 +14,30 @@
 
 package main
 
-import (
-	"bufio"
-	"compress/gzip"
-	"fmt"
-	"io"
-	"log"
-	"os"
-	"strings"
-
-	"github.com/ulikunitz/xz"
-)
+import "fmt"
 
 func added(old_name, new_name string) {
 
-	var zr io.Reader
-
 	file_list := make(map[string]string)
-
-	func() {
-		if strings.HasPrefix(old_name, "http") {
-			resp, err := client.Get(old_name)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer resp.Body.Close()
-
-			if strings.HasSuffix(old_name, ".gz") {
-				gzr, err := gzip.NewReader(resp.Body)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				defer gzr.Close()
-				zr = io.Reader(gzr)
-			} else if strings.HasSuffix(old_name, ".xz") {
-				xzr, err := xz.NewReader(resp.Body)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				//defer xzr.Close()
-				defer func() { xzr = nil }()
-				zr = io.Reader(xzr)
-			} else {
-				zr = resp.Body
-			}
-
-		} else {
-
-			file, err := os.OpenFile(old_name, os.O_RDONLY, 0666)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			defer file.Close()
-
-			if strings.HasSuffix(old_name, ".gz") {
-				gzr, err := gzip.NewReader(file)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				defer gzr.Close()
-				zr = io.Reader(gzr)
-			} else if strings.HasSuffix(old_name, ".xz") {
-				xzr, err := xz.NewReader(file)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				//defer xzr.Close()
-				defer func() { xzr = nil }()
-				zr = io.Reader(xzr)
-			} else {
-				zr = file
-			}
-		}
-
-		scanner := bufio.NewScanner(zr)
-		var line, filename, h_md5, h_sha1, h_sha256, h_sha512, size string
-		for {
-			if scanner.Scan() {
-				line = scanner.Text()
-			} else {
-				break
-			}
-			parts := strings.SplitN(line, ": ", 2)
-			val := ""
-			if len(parts) == 2 {
-				val = strings.TrimSpace(parts[1])
-			}
-			switch parts[0] {
-			case "Filename":
-				filename = val
-			case "Size":
-				size = val
-			case "MD5sum":
-				h_md5 = val
-			case "SHA1":
-				h_sha1 = val
-			case "SHA256":
-				h_sha256 = val
-			case "SHA512":
-				h_sha512 = val
-			case "":
-				if filename != "" {
-					file_list[filename] = fmt.Sprintf("%s|%s|%s|%s|%s", size, h_md5, h_sha1, h_sha256, h_sha512)
-				}
-				filename, h_md5, h_sha1, h_sha256, h_sha512, size = "", "", "", "", "", ""
-				continue
-			}
-		}
-	}()
-
-	func() {
-		if strings.HasPrefix(old_name, "http") {
-			resp, err := client.Get(old_name)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer resp.Body.Close()
-
-			if strings.HasSuffix(old_name, ".gz") {
-				gzr, err := gzip.NewReader(resp.Body)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				defer gzr.Close()
-				zr = io.Reader(gzr)
-			} else if strings.HasSuffix(old_name, ".xz") {
-				xzr, err := xz.NewReader(resp.Body)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				//defer xzr.Close()
-				defer func() { xzr = nil }()
-				zr = io.Reader(xzr)
-			} else {
-				zr = resp.Body
-			}
-
-		} else {
-
-			file, err := os.OpenFile(old_name, os.O_RDONLY, 0666)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			defer file.Close()
-
-			if strings.HasSuffix(old_name, ".gz") {
-				gzr, err := gzip.NewReader(file)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				defer gzr.Close()
-				zr = io.Reader(gzr)
-			} else if strings.HasSuffix(old_name, ".xz") {
-				xzr, err := xz.NewReader(file)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				//defer xzr.Close()
-				defer func() { xzr = nil }()
-				zr = io.Reader(xzr)
-			} else {
-				zr = file
-			}
-		}
-
-		scanner := bufio.NewScanner(zr)
-		var line, filename, h_md5, h_sha1, h_sha256, h_sha512, size string
-		for {
-			if scanner.Scan() {
-				line = scanner.Text()
-			} else {
-				break
-			}
-			parts := strings.SplitN(line, ": ", 2)
-			val := ""
-			if len(parts) == 2 {
-				val = strings.TrimSpace(parts[1])
-			}
-			switch parts[0] {
-			case "Filename":
-				filename = val
-			case "Size":
-				size = val
-			case "MD5sum":
-				h_md5 = val
-			case "SHA1":
-				h_sha1 = val
-			case "SHA256":
-				h_sha256 = val
-			case "SHA512":
-				h_sha512 = val
-			case "":
-				if filename != "" {
-					hash, ok := file_list[filename]
-					if !ok || hash != fmt.Sprintf("%s|%s|%s|%s|%s", size, h_md5, h_sha1, h_sha256, h_sha512) {
-						fmt.Printf("%d %s\n", size, filename)
-					}
-				}
-				filename, h_md5, h_sha1, h_sha256, h_sha512, size = "", "", "", "", "", ""
-				continue
-			}
+	file_id := func(f indexFile) string {
+		return fmt.Sprintf("%s|%s|%s|%s|%s", f.Size, f.Sums["MD5sum"],
+			f.Sums["SHA1"], f.Sums["SHA256"], f.Sums["SHA512"])
+	}
+
+	err := loadIndex(old_name, func(f indexFile) {
+		file_list[f.Filename] = file_id(f)
+	})
+	if err != nil {
+		out.Error(old_name, err)
+	}
+
+	err = loadIndex(new_name, func(f indexFile) {
+		hash, ok := file_list[f.Filename]
+		if !ok || hash != file_id(f) {
+			out.Record(record{File: f.Filename, Status: "added", Size: f.Size, Index: new_name})
 		}
-	}()
+	})
+	if err != nil {
+		out.Error(new_name, err)
+	}
 }
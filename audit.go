@@ -0,0 +1,294 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// The logical indexes, with any compression suffix removed, which lead from a
+// Release file to the pool.
+var audit_indexes = []string{"Packages", "Sources"}
+
+// An audit_scope limits an audit to some suites, components and
+// architectures ("source" for the Sources indexes), empty lists allow
+// everything.  The policy, if any, applies to every Release on top of the
+// configured ones.
+type audit_scope struct {
+	suites, components, archs []string
+	policy                    *signer_policy
+}
+
+type audit_result struct {
+	releases, bad_releases int
+	indexes, bad_indexes   int
+	files, missing, failed int
+	by_hash, bad_by_hash   int
+	stale                  int
+}
+
+// findReleases returns the signed Release file of every suite under
+// root/dists, or of only the suites listed, preferring InRelease over a
+// detached Release.gpg.  A suite without either is recorded as missing, so
+// one whose signature was removed does not silently drop out of the audit.
+func findReleases(root string, only []string) (releases []string) {
+	var suites []string
+	matches, _ := filepath.Glob(path.Join(root, "dists", "*"))
+	for _, suite := range matches {
+		if fi, err := os.Stat(suite); err == nil && fi.IsDir() {
+			suites = append(suites, suite)
+		}
+	}
+	if len(only) > 0 {
+		suites = nil
+		for _, suite := range only {
+			suites = append(suites, path.Join(root, "dists", suite))
+		}
+	}
+	for _, suite := range suites {
+		found := false
+		for _, name := range []string{"InRelease", "Release.gpg"} {
+			if fi, err := os.Stat(path.Join(suite, name)); err == nil && fi.Mode().IsRegular() {
+				releases = append(releases, path.Join(suite, name))
+				found = true
+				break
+			}
+		}
+		if !found {
+			out.Record(record{File: path.Join(suite, "InRelease"), Status: "missing"})
+		}
+	}
+	return
+}
+
+// audit walks a repo from its signed Release files, through the Packages and
+// Sources indexes they authenticate, down to the pool files those indexes
+// list.  Pool files are only checked against indexes which matched their
+// signed checksums, so a tampered index cannot vouch for a tampered pool.
+// The scope may be nil to audit the whole repo.
+func audit(root string, keyring openpgp.KeyRing, scope *audit_scope) error {
+	if scope == nil {
+		scope = &audit_scope{}
+	}
+	out.Println("Auditing", root)
+	var res audit_result
+
+	// Authenticate the indexes, only one variant of each logical index is
+	// needed as the compressed and uncompressed copies carry the same list.
+	var indexes []string
+	signers := make(map[string]string)
+	buf := new(hash_buf)
+	for _, release := range findReleases(root, scope.suites) {
+		res.releases++
+		sf, err := readSigned(release, keyring)
+		if err != nil {
+			out.Error(release, signatureFailure(fmt.Errorf("%s %v", release, err)))
+			res.bad_releases++
+			continue
+		}
+		if err = crossCheck(sf, keyring); err != nil {
+			out.Error(release, signatureFailure(err))
+			res.bad_releases++
+			continue
+		}
+		if err = checkPolicies(sf, scope.policy); err != nil {
+			out.Error(release, signatureFailure(err))
+			res.bad_releases++
+			continue
+		}
+		if err = checkFreshness(sf); err != nil {
+			out.Error(release, signatureFailure(err))
+			res.bad_releases++
+			continue
+		}
+		out.Record(record{File: release, Status: "ok", Signer: sf.signerID(), Signatures: sf.signatures})
+		file_hashes, err := releaseHashes(strings.NewReader(sf.content), release)
+		if err != nil {
+			out.Error(release, err)
+			res.bad_releases++
+			continue
+		}
+
+		dist_dir, _ := path.Split(release)
+		signer := sf.signerID()
+		// An index is missing when none of its variants are here, as its
+		// pool files would otherwise drop out of the audit unnoticed
+		seen := make(map[string]bool)
+		present := make(map[string]bool)
+		var listed []string
+		for _, filename := range sortedKeys(file_hashes) {
+			logical := filename
+			for _, ext := range compressed_exts {
+				logical = strings.TrimSuffix(logical, ext)
+			}
+			if seen[logical] || !isAuditIndex(logical) || !scope.allowsIndex(logical) {
+				continue
+			}
+			if !contains(listed, logical) {
+				listed = append(listed, logical)
+			}
+			local := path.Join(dist_dir, filename)
+			if _, err := os.Stat(local); os.IsNotExist(err) {
+				continue
+			}
+			present[logical] = true
+			res.indexes++
+			rec := sumRecord(local, file_hashes[filename], buf)
+			rec.Index, rec.Signer = release, signer
+			out.Record(rec)
+			if rec.Status != "ok" {
+				res.bad_indexes++
+				continue
+			}
+			seen[logical] = true
+			indexes = append(indexes, local)
+			signers[local] = signer
+		}
+
+		for _, logical := range listed {
+			if !present[logical] {
+				out.Record(record{File: path.Join(dist_dir, logical), Status: "missing", Size: file_hashes[logical]["Size"],
+					Index: release, Signer: signer})
+				res.missing++
+			}
+		}
+
+		by_hash, err := checkByHash(sf, file_hashes, scope)
+		if err != nil {
+			out.Error(release, err)
+		}
+		res.by_hash += by_hash.checked
+		res.missing += by_hash.missing
+		res.bad_by_hash += by_hash.failed
+		res.stale += by_hash.stale
+	}
+
+	// Check the pool against the authenticated indexes, a file listed in more
+	// than one index (such as an arch all package) is only checked once.
+	checked := make(map[string]bool)
+	p := newPipeline(*jobs)
+	for _, index := range indexes {
+		err := loadIndex(index, func(f indexFile) {
+			local := path.Join(root, f.Filename)
+			if checked[local] {
+				return
+			}
+			checked[local] = true
+			if _, err := os.Stat(local); os.IsNotExist(err) {
+				p.Go(nil, func() {
+					out.Record(record{File: local, Status: "missing", Size: f.Size, Index: index, Signer: signers[index]})
+					res.files++
+					res.missing++
+				})
+				return
+			}
+			want := map[string]string{"Size": f.Size}
+			for k, v := range f.Sums {
+				want[k] = v
+			}
+			var rec record
+			p.Go(func(buf *hash_buf) {
+				rec = sumRecord(local, want, buf)
+			}, func() {
+				rec.Index, rec.Signer = index, signers[index]
+				out.Record(rec)
+				res.files++
+				if rec.Status != "ok" {
+					res.failed++
+				}
+			})
+		})
+		if err != nil {
+			p.Go(nil, func() {
+				out.Error(index, err)
+				res.bad_indexes++
+			})
+		}
+	}
+	p.Wait()
+
+	out.Total("releases", uint64(res.releases))
+	out.Total("bad_releases", uint64(res.bad_releases))
+	out.Total("indexes", uint64(res.indexes))
+	out.Total("bad_indexes", uint64(res.bad_indexes))
+	out.Total("by_hash", uint64(res.by_hash))
+	out.Total("bad_by_hash", uint64(res.bad_by_hash))
+	out.Total("files", uint64(res.files))
+	out.Total("missing", uint64(res.missing))
+	out.Printf("Audit of %s: releases %d (%d bad), indexes %d (%d bad), by-hash %d (%d bad, %d stale), files %d (%d failed), %d missing\n",
+		root, res.releases, res.bad_releases, res.indexes, res.bad_indexes, res.by_hash, res.bad_by_hash, res.stale,
+		res.files, res.failed, res.missing)
+	if res.releases == 0 {
+		return signatureFailure(errors.New("no signed Release files found under " + path.Join(root, "dists")))
+	}
+	if res.bad_releases > 0 || res.bad_indexes > 0 || res.bad_by_hash > 0 || res.failed > 0 {
+		return errFailed
+	}
+	return nil
+}
+
+// allowsIndex reports whether a Release entry, such as
+// main/binary-amd64/Packages or main/source/Sources, is in the components
+// and architectures of the scope, which may be nil to allow everything.
+func (scope *audit_scope) allowsIndex(logical string) bool {
+	if scope == nil {
+		return true
+	}
+	parts := strings.Split(logical, "/")
+	if len(parts) == 1 {
+		// Not in any component, such as Contents-all.gz
+		return true
+	}
+	if len(scope.components) > 0 && !contains(scope.components, parts[0]) {
+		return false
+	}
+	if len(scope.archs) == 0 {
+		return true
+	}
+	for _, part := range parts[1:] {
+		if part == "source" || strings.HasPrefix(part, "binary-") {
+			return contains(scope.archs, strings.TrimPrefix(part, "binary-"))
+		}
+	}
+	return true
+}
+
+// contains reports whether list holds s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuditIndex reports whether a Release entry is a Packages or Sources index.
+func isAuditIndex(logical string) bool {
+	base := path.Base(logical)
+	for _, index := range audit_indexes {
+		if base == index {
+			return true
+		}
+	}
+	return false
+}
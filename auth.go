@@ -0,0 +1,270 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A credential is a netrc or apt auth.conf entry.  machine is a host, with
+// an optional port, scheme and path prefix, or empty for a netrc default
+// entry.  An entry with a password but no login gives a bearer token.  apt
+// marks the entries of an auth.conf, which apt only uses for http:// when
+// the machine says so.
+type credential struct {
+	machine  string
+	login    string
+	password string
+	apt      bool
+}
+
+// The credentials read from the -auth files, loaded with the first request.
+var (
+	credentials      []credential
+	credentials_err  error
+	credentials_once sync.Once
+)
+
+// authFiles returns the files named by -auth, or the usual ones: $NETRC or
+// ~/.netrc, /etc/apt/auth.conf and the .conf files in /etc/apt/auth.conf.d.
+// The usual files are skipped when they do not exist.
+func authFiles() (files []string, optional bool) {
+	if len(auth_files) > 0 {
+		for _, name := range auth_files {
+			files = append(files, localPath(name))
+		}
+		return files, false
+	}
+	if netrc := os.Getenv("NETRC"); netrc != "" {
+		files = append(files, netrc)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".netrc"))
+	}
+	return append(files, "/etc/apt/auth.conf", "/etc/apt/auth.conf.d"), true
+}
+
+// loadCredentials reads every auth file, a directory is read for its .conf
+// files in name order as apt does.  A usual file which cannot be read, such
+// as a root only auth.conf.d file for a cron job, is skipped with a warning
+// so that anonymous requests still work, only the -auth files must be read.
+func loadCredentials() ([]credential, error) {
+	names, optional := authFiles()
+	var creds []credential
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			if optional && os.IsNotExist(err) {
+				continue
+			} else if optional {
+				out.Println("warning:", err)
+				continue
+			}
+			return nil, err
+		}
+		files := []string{name}
+		if fi.IsDir() {
+			entries, err := ioutil.ReadDir(name)
+			if err != nil {
+				if optional {
+					out.Println("warning:", err)
+					continue
+				}
+				return nil, err
+			}
+			files = nil
+			for _, e := range entries {
+				if e.Mode().IsRegular() && path.Ext(e.Name()) == ".conf" {
+					files = append(files, filepath.Join(name, e.Name()))
+				}
+			}
+			sort.Strings(files)
+		}
+		for _, file := range files {
+			c, err := readAuthFile(file)
+			if err != nil {
+				if optional {
+					out.Println("warning:", err)
+					continue
+				}
+				return nil, err
+			}
+			creds = append(creds, c...)
+		}
+	}
+	return creds, nil
+}
+
+// readAuthFile reads the netrc format used by ~/.netrc and apt's auth.conf,
+// "machine HOST login USER password PASS" tokens on one or more lines.
+// Unknown tokens are ignored, as curl and apt do.  The errors never quote a
+// token as it may be a password.
+func readAuthFile(name string) (creds []credential, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// apt's auth.conf and the files of auth.conf.d are told apart from a
+	// netrc by their .conf extension.
+	apt := filepath.Ext(name) == ".conf"
+	var c *credential
+	in_macro := false
+	scanner := bufio.NewScanner(file)
+	for line_no := 1; scanner.Scan(); line_no++ {
+		line := scanner.Text()
+		if in_macro {
+			// A macdef runs to the next blank line
+			in_macro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		tokens := strings.Fields(line)
+		for i := 0; i < len(tokens); i++ {
+			switch tokens[i] {
+			case "default":
+				creds = append(creds, credential{})
+				c = &creds[len(creds)-1]
+				continue
+			case "macdef":
+				in_macro = true
+				i = len(tokens)
+				continue
+			case "machine", "login", "password", "account", "port":
+			default:
+				continue
+			}
+			if i+1 == len(tokens) {
+				return nil, fmt.Errorf("%s:%d: %s needs a value", name, line_no, tokens[i])
+			}
+			value := tokens[i+1]
+			switch tokens[i] {
+			case "machine":
+				creds = append(creds, credential{machine: value, apt: apt})
+				c = &creds[len(creds)-1]
+			case "login", "password":
+				if c == nil {
+					return nil, fmt.Errorf("%s:%d: %s before any machine", name, line_no, tokens[i])
+				}
+				if tokens[i] == "login" {
+					c.login = value
+				} else {
+					c.password = value
+				}
+			}
+			i++
+		}
+	}
+	return creds, scanner.Err()
+}
+
+// match returns how well the entry matches u, the length of its path prefix,
+// or -1 when it does not apply.  A netrc default entry matches any https URL
+// as the weakest match, and http ones only with -auth-http.  A machine
+// without a scheme matches http and https in a netrc, but only https in an
+// auth.conf, as with apt.
+func (c *credential) match(u *url.URL) int {
+	if c.machine == "" {
+		if !*auth_http && !strings.EqualFold(u.Scheme, "https") {
+			return -1
+		}
+		return 0
+	}
+	machine := c.machine
+	if i := strings.Index(machine, "://"); i >= 0 {
+		if !strings.EqualFold(machine[:i], u.Scheme) {
+			return -1
+		}
+		machine = machine[i+3:]
+	} else if c.apt && !strings.EqualFold(u.Scheme, "https") {
+		return -1
+	}
+	host, prefix := machine, ""
+	if i := strings.IndexByte(machine, '/'); i >= 0 {
+		host, prefix = machine[:i], machine[i:]
+	}
+	if !strings.EqualFold(host, u.Host) && (strings.Contains(host, ":") || !strings.EqualFold(host, u.Hostname())) {
+		return -1
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/") {
+		return -1
+	}
+	return len(prefix) + 1
+}
+
+// findCredential returns the entry with the longest path prefix matching u,
+// the first one read when several match as well.
+func findCredential(u *url.URL) (*credential, error) {
+	credentials_once.Do(func() {
+		credentials, credentials_err = loadCredentials()
+	})
+	if credentials_err != nil {
+		return nil, credentials_err
+	}
+	var best *credential
+	best_match := -1
+	for i := range credentials {
+		if m := credentials[i].match(u); m > best_match {
+			best, best_match = &credentials[i], m
+		}
+	}
+	return best, nil
+}
+
+// authorize adds the entry's login and password to req, or its password as a
+// bearer token when it has no login.
+func (c *credential) authorize(req *http.Request) {
+	if c.login != "" {
+		req.SetBasicAuth(c.login, c.password)
+	} else if c.password != "" {
+		req.Header.Set("Authorization", "Bearer "+c.password)
+	}
+}
+
+// redactURL hides the password of a URL with credentials in it, so that
+// file names can be printed.
+func redactURL(name string) string {
+	if !strings.Contains(name, "@") || !strings.Contains(name, "://") {
+		return name
+	}
+	u, err := url.Parse(name)
+	if err != nil {
+		return name
+	}
+	return u.Redacted()
+}
+
+// redactArgs applies redactURL to the string arguments of a print.
+func redactArgs(a []interface{}) []interface{} {
+	for i, v := range a {
+		if s, ok := v.(string); ok {
+			a[i] = redactURL(s)
+		}
+	}
+	return a
+}
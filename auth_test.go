@@ -0,0 +1,137 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCredentialMatch(t *testing.T) {
+	tests := []struct {
+		cred      credential
+		url       string
+		auth_http bool
+		want      int
+	}{
+		{credential{machine: "example.com"}, "https://example.com/debian/dists", false, 1},
+		{credential{machine: "example.com"}, "http://example.com/debian/dists", false, 1},
+		{credential{machine: "EXAMPLE.com"}, "https://example.com:8443/x", false, 1},
+		{credential{machine: "example.com:8443"}, "https://example.com:8443/x", false, 1},
+		{credential{machine: "example.com:8443"}, "https://example.com/x", false, -1},
+		{credential{machine: "example.com"}, "https://mirror.example.com/x", false, -1},
+		{credential{machine: "https://example.com"}, "https://example.com/x", false, 1},
+		{credential{machine: "https://example.com"}, "http://example.com/x", false, -1},
+		{credential{machine: "http://example.com"}, "http://example.com/x", false, 1},
+		{credential{machine: "example.com/debian"}, "https://example.com/debian/dists", false, 8},
+		{credential{machine: "example.com/debian/"}, "https://example.com/debian", false, 8},
+		{credential{machine: "example.com/debian"}, "https://example.com/debian-security/dists", false, -1},
+		{credential{machine: "https://example.com:8443/debian"}, "https://example.com:8443/debian/x", false, 8},
+		{credential{machine: "example.com", apt: true}, "https://example.com/x", false, 1},
+		{credential{machine: "example.com", apt: true}, "http://example.com/x", false, -1},
+		{credential{machine: "http://example.com", apt: true}, "http://example.com/x", false, 1},
+		{credential{}, "https://example.com/x", false, 0},
+		{credential{}, "http://example.com/x", false, -1},
+		{credential{}, "http://example.com/x", true, 0},
+	}
+	defer func(v bool) { *auth_http = v }(*auth_http)
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*auth_http = tt.auth_http
+		if got := tt.cred.match(u); got != tt.want {
+			t.Errorf("%+v %s: match %d, want %d", tt.cred, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestFindCredential(t *testing.T) {
+	dir := t.TempDir()
+	netrc := filepath.Join(dir, "netrc")
+	os.WriteFile(netrc, []byte("machine example.com login netrc password a\n"+
+		"machine example.com/debian login prefix password b\n"+
+		"machine example.com/debian login second password c\n"+
+		"machine token.example.com password TOKEN unknown-token\n"+
+		"default login anon password d\n"), 0600)
+	conf_d := filepath.Join(dir, "auth.conf.d")
+	os.Mkdir(conf_d, 0755)
+	os.WriteFile(filepath.Join(conf_d, "10apt.conf"), []byte("machine apt.example.com login apt password e\n"), 0600)
+	os.WriteFile(filepath.Join(conf_d, "ignored.txt"), []byte("machine apt.example.com login txt password f\n"), 0600)
+
+	tests := []struct {
+		url      string
+		password string // "" for no credential
+	}{
+		{"https://example.com/ubuntu/dists", "a"},
+		{"https://example.com/debian/dists", "b"},
+		{"http://example.com/debian/dists", "b"},
+		{"https://token.example.com/x", "TOKEN"},
+		{"https://apt.example.com/x", "e"},
+		{"http://apt.example.com/x", ""},
+		{"https://other.example.com/x", "d"},
+		{"http://other.example.com/x", ""},
+	}
+	defer func(files string_list) {
+		auth_files, credentials_once = files, sync.Once{}
+	}(auth_files)
+	auth_files, credentials_once = string_list{netrc, conf_d}, sync.Once{}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		c, err := findCredential(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var password string
+		if c != nil {
+			password = c.password
+		}
+		if password != tt.password {
+			t.Errorf("%s: password %q, want %q", tt.url, password, tt.password)
+		}
+	}
+}
+
+func TestLoadCredentialsErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "netrc")
+	os.WriteFile(bad, []byte("login alice password s3cret\n"), 0600)
+	defer func(files string_list) {
+		auth_files, credentials_once = files, sync.Once{}
+	}(auth_files)
+
+	// A broken -auth file fails every request
+	auth_files = string_list{bad}
+	if _, err := loadCredentials(); err == nil {
+		t.Error("-auth file with login before machine: no error")
+	}
+
+	// A broken usual file is skipped
+	auth_files = nil
+	t.Setenv("NETRC", bad)
+	creds, err := loadCredentials()
+	if err != nil {
+		t.Errorf("usual netrc with login before machine: %v", err)
+	}
+	for _, c := range creds {
+		if c.login == "alice" {
+			t.Errorf("usual netrc with login before machine: read %+v", c)
+		}
+	}
+}
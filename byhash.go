@@ -0,0 +1,122 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The by-hash directory apt uses for each of the Release checksum fields.
+var by_hash_dirs = map[string]string{
+	"MD5sum": "MD5Sum",
+	"SHA1":   "SHA1",
+	"SHA256": "SHA256",
+	"SHA512": "SHA512",
+}
+
+type by_hash_result struct {
+	checked, missing, failed, stale int
+}
+
+// checkByHash verifies the dists/*/by-hash/<digest>/<value> copies of the
+// files listed in a Release with "Acquire-By-Hash: yes" against the Release
+// checksums, which also proves each file matches its name.  Entries which are
+// missing while their by-hash directory and the file itself exist are
+// reported, as are by-hash entries no longer referenced by the Release.  Only
+// the components and architectures of the scope, which may be nil, are
+// checked.
+func checkByHash(sf *signedFile, file_hashes map[string]map[string]string, scope *audit_scope) (res by_hash_result, err error) {
+	rel, err := newStanzaReader(strings.NewReader(sf.content), sf.signed).Next()
+	if err == io.EOF {
+		return res, nil
+	}
+	if err != nil {
+		return
+	}
+	if !strings.EqualFold(rel.Get("Acquire-By-Hash"), "yes") {
+		return
+	}
+
+	dist_dir, _ := path.Split(sf.signed)
+	if dist_dir == "" {
+		dist_dir = "."
+	}
+	signer := sf.signerID()
+	referenced := make(map[string]bool)
+	buf := new(hash_buf)
+	for _, filename := range sortedKeys(file_hashes) {
+		sums := file_hashes[filename]
+		if !scope.allowsIndex(filename) {
+			continue
+		}
+		// Debian lists the uncompressed indexes without publishing them, so
+		// only a file which is present needs a by-hash copy.
+		_, err := os.Stat(path.Join(dist_dir, filename))
+		present := err == nil
+		for _, k := range package_sums {
+			v, ok := sums[k]
+			if !ok {
+				continue
+			}
+			by_hash_dir := path.Join(dist_dir, path.Dir(filename), "by-hash", by_hash_dirs[k])
+			by_hash := path.Join(by_hash_dir, v)
+			if referenced[by_hash] {
+				continue
+			}
+			referenced[by_hash] = true
+			if _, err := os.Stat(by_hash); os.IsNotExist(err) {
+				if _, err := os.Stat(by_hash_dir); err == nil && present {
+					out.Record(record{File: by_hash, Status: "missing", Size: sums["Size"], Index: sf.name, Signer: signer})
+					res.missing++
+				}
+				continue
+			}
+			res.checked++
+			rec := sumRecord(by_hash, sums, buf)
+			rec.Index, rec.Signer = sf.name, signer
+			out.Record(rec)
+			if rec.Status != "ok" {
+				res.failed++
+			}
+		}
+	}
+
+	var stale []string
+	err = filepath.Walk(dist_dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") || referenced[name] {
+			return nil
+		}
+		by_hash_dir := path.Dir(path.Dir(name))
+		if rel, err := filepath.Rel(dist_dir, by_hash_dir); err == nil &&
+			path.Base(by_hash_dir) == "by-hash" && scope.allowsIndex(filepath.ToSlash(rel)) {
+			stale = append(stale, name)
+		}
+		return nil
+	})
+	sort.Strings(stale)
+	for _, name := range stale {
+		out.Record(record{File: name, Status: "stale", Index: sf.name, Signer: signer})
+	}
+	res.stale = len(stale)
+	return
+}
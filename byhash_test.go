@@ -0,0 +1,103 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckByHash(t *testing.T) {
+	const (
+		sha256_one = "7692c3ad3540bb803c020b3aee66cd8887123234ea0c6e7143c0add73ff431ed"
+		amd64      = "main/binary-amd64/"
+		i386       = "main/binary-i386/"
+	)
+	file_hashes := map[string]map[string]string{
+		amd64 + "Packages":    {"SHA256": sha256_one, "Size": "3"},
+		amd64 + "Packages.gz": {"SHA256": "11" + sha256_one[2:], "Size": "3"},
+	}
+	tests := []struct {
+		name    string
+		release string
+		files   map[string]string // the files under the dists directory
+		scope   *audit_scope
+		want    by_hash_result
+	}{
+		{name: "good", files: map[string]string{
+			amd64 + "Packages": "one", amd64 + "by-hash/SHA256/" + sha256_one: "one"},
+			want: by_hash_result{checked: 1}},
+		{name: "corrupt", files: map[string]string{
+			amd64 + "Packages": "one", amd64 + "by-hash/SHA256/" + sha256_one: "two"},
+			want: by_hash_result{checked: 1, failed: 1}},
+		{name: "missing", files: map[string]string{
+			amd64 + "Packages": "one", amd64 + "Packages.gz": "one", amd64 + "by-hash/SHA256/" + sha256_one: "one"},
+			want: by_hash_result{checked: 1, missing: 1}},
+		{name: "index not published", files: map[string]string{
+			amd64 + "Packages.gz": "one", amd64 + "by-hash/SHA256/11" + sha256_one[2:]: "one"},
+			want: by_hash_result{checked: 1, failed: 1}},
+		{name: "no by-hash directory", files: map[string]string{amd64 + "Packages": "one"}},
+		{name: "stale", files: map[string]string{
+			amd64 + "Packages": "one", amd64 + "by-hash/SHA256/" + sha256_one: "one",
+			amd64 + "by-hash/SHA256/" + sha256_one[:60] + "0000": "old", amd64 + "by-hash/SHA256/.hidden": ""},
+			want: by_hash_result{checked: 1, stale: 1}},
+		{name: "stale out of scope", files: map[string]string{
+			amd64 + "Packages": "one", amd64 + "by-hash/SHA256/" + sha256_one: "one", i386 + "by-hash/SHA256/00": "old"},
+			scope: &audit_scope{archs: []string{"amd64"}},
+			want:  by_hash_result{checked: 1}},
+		{name: "index out of scope", files: map[string]string{
+			amd64 + "Packages": "one", amd64 + "Packages.gz": "one", amd64 + "by-hash/SHA256/00": "old"},
+			scope: &audit_scope{archs: []string{"i386"}}},
+		{name: "not by-hash", release: "Suite: stable\n", files: map[string]string{
+			amd64 + "Packages": "one", amd64 + "by-hash/SHA256/00": "old"}},
+	}
+	defer func(r *reporter) { out = r }(out)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out = newReporter("json", "test")
+			out.w = io.Discard
+			dist_dir := filepath.Join(t.TempDir(), "dists", "stable")
+			for name, content := range tt.files {
+				name = filepath.Join(dist_dir, name)
+				os.MkdirAll(filepath.Dir(name), 0755)
+				if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			release := tt.release
+			if release == "" {
+				release = "Suite: stable\nAcquire-By-Hash: yes\n"
+			}
+			sf := &signedFile{name: dist_dir + "/InRelease", signed: dist_dir + "/InRelease", content: release}
+			res, err := checkByHash(sf, file_hashes, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != tt.want {
+				t.Errorf("got %+v, want %+v", res, tt.want)
+			}
+			statuses := make(map[string]int)
+			for _, rec := range out.records {
+				statuses[rec.Status]++
+			}
+			if statuses["missing"] != tt.want.missing || statuses["stale"] != tt.want.stale ||
+				statuses["mismatch"] != tt.want.failed {
+				t.Errorf("records %v, want %+v", statuses, tt.want)
+			}
+		})
+	}
+}
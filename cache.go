@@ -0,0 +1,272 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A sum_cache stores the .sum record (size, digests and file details) of each
+// file hashed.  Load returns an empty map when there is no record, Walk calls
+// fn with the name of every file under dir which has a record.  KeepsCtime
+// reports whether storing a record leaves the ctime of the file alone, so the
+// ctime can be recorded.
+type sum_cache interface {
+	Load(name string) map[string]string
+	Store(name string, sums map[string]string) error
+	Remove(name string) error
+	Walk(dir string, fn func(name string)) error
+	KeepsCtime() bool
+	Close() error
+}
+
+// The cache used for all the .sum records, chosen by the -cache option.
+var cache sum_cache = dotfile_cache{}
+
+// openCache returns the cache described by spec, which is "dotfile" for a
+// ".<name>.sum" file next to every file (the default), "shadow:DIR" for the
+// same files in a parallel tree under DIR, "xattr" for an extended attribute
+// on the file itself or "db:FILE" for a single database file.
+func openCache(spec string) (sum_cache, error) {
+	kind, arg := splitCacheSpec(spec)
+	switch kind {
+	case "", "dotfile":
+		return dotfile_cache{}, nil
+	case "shadow":
+		if arg == "" {
+			return nil, fmt.Errorf("cache %q needs a directory", spec)
+		}
+		root, err := filepath.Abs(localPath(arg))
+		return shadow_cache{root: root}, err
+	case "xattr":
+		return xattr_cache{}, nil
+	case "db":
+		if arg == "" {
+			return nil, fmt.Errorf("cache %q needs a file name", spec)
+		}
+		return openDBCache(localPath(arg))
+	}
+	return nil, fmt.Errorf("unknown cache %q", spec)
+}
+
+// splitCacheSpec splits a -cache value into the kind of cache and its
+// directory or file name.
+func splitCacheSpec(spec string) (kind, arg string) {
+	kind = spec
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	if kind == "" {
+		kind = "dotfile"
+	}
+	return
+}
+
+// sameCache reports whether the specs a and b name the same cache, such as
+// db:FILE given once with a relative and once with an absolute name.
+func sameCache(a, b string) bool {
+	a_kind, a_arg := splitCacheSpec(a)
+	b_kind, b_arg := splitCacheSpec(b)
+	if a_kind != b_kind {
+		return false
+	}
+	a_abs, a_err := filepath.Abs(localPath(a_arg))
+	b_abs, b_err := filepath.Abs(localPath(b_arg))
+	return a_arg == b_arg || (a_err == nil && b_err == nil && a_abs == b_abs)
+}
+
+// A shared_cache hands out the -cache cache a second time, it is closed as
+// the run exits rather than by its second user.
+type shared_cache struct{ sum_cache }
+
+func (shared_cache) Close() error { return nil }
+
+// openMigrateCache opens the cache named by spec for migrate-cache, reusing
+// the -cache one when they are the same as a database cannot be opened twice.
+func openMigrateCache(spec string) (sum_cache, error) {
+	if sameCache(spec, *cache_opt) {
+		return shared_cache{cache}, nil
+	}
+	return openCache(spec)
+}
+
+// formatSums writes a record in the .sum file format.
+func formatSums(sums map[string]string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Size: %s\n", sums["Size"])
+	for _, d := range digests {
+		if v, ok := sums[d.name]; ok {
+			fmt.Fprintf(&buf, "%s: %s\n", d.name, v)
+		}
+	}
+	for _, k := range []string{"Mtime", "Inode", "Ctime"} {
+		if v, ok := sums[k]; ok {
+			fmt.Fprintf(&buf, "%s: %s\n", k, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// parseSums reads a record in the .sum file format.
+func parseSums(data []byte, name string) map[string]string {
+	sums := make(map[string]string)
+	err := readStanzas(bytes.NewReader(data), name, func(s *stanza) error {
+		for _, f := range s.Fields {
+			sums[f.Name] = f.Value
+		}
+		return nil
+	})
+	if err != nil {
+		out.Println("warning:", err)
+	}
+	return sums
+}
+
+// writeAtomic replaces a file through a temporary file and a rename, so a
+// reader never sees a partly written one.
+func writeAtomic(name string, data []byte) error {
+	dir_name, file_name := path.Split(name)
+	if dir_name == "" {
+		dir_name = "."
+	}
+	tmp, err := ioutil.TempFile(dir_name, file_name+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// dotfile_cache keeps each record in a ".<name>.sum" file next to the file.
+type dotfile_cache struct{}
+
+func (dotfile_cache) path(name string) string {
+	dir_name, file_name := path.Split(name)
+	return path.Join(dir_name, fmt.Sprintf(".%s.sum", file_name))
+}
+
+func (c dotfile_cache) Load(name string) map[string]string {
+	data, err := ioutil.ReadFile(c.path(name))
+	if err != nil {
+		return make(map[string]string)
+	}
+	return parseSums(data, c.path(name))
+}
+
+func (c dotfile_cache) Store(name string, sums map[string]string) error {
+	return writeAtomic(c.path(name), formatSums(sums))
+}
+
+func (c dotfile_cache) Remove(name string) error {
+	return os.Remove(c.path(name))
+}
+
+func (dotfile_cache) Walk(dir string, fn func(name string)) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		file_name := fi.Name()
+		if fi.Mode().IsRegular() && strings.HasPrefix(file_name, ".") && strings.HasSuffix(file_name, ".sum") {
+			fn(path.Join(path.Dir(filepath.ToSlash(p)), strings.TrimSuffix(file_name[1:], ".sum")))
+		}
+		return nil
+	})
+}
+
+func (dotfile_cache) KeepsCtime() bool { return true }
+
+func (dotfile_cache) Close() error { return nil }
+
+// shadow_cache keeps each record in a "<name>.sum" file under a separate root
+// directory, mirroring the absolute path of the file, so nothing is added to
+// the served tree.
+type shadow_cache struct {
+	root string
+}
+
+func (c shadow_cache) path(name string) string {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		abs = name
+	}
+	return filepath.Join(c.root, abs) + ".sum"
+}
+
+func (c shadow_cache) Load(name string) map[string]string {
+	data, err := ioutil.ReadFile(c.path(name))
+	if err != nil {
+		return make(map[string]string)
+	}
+	return parseSums(data, c.path(name))
+}
+
+func (c shadow_cache) Store(name string, sums map[string]string) error {
+	sum_name := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(sum_name), 0755); err != nil {
+		return err
+	}
+	return writeAtomic(sum_name, formatSums(sums))
+}
+
+func (c shadow_cache) Remove(name string) error {
+	return os.Remove(c.path(name))
+}
+
+func (c shadow_cache) Walk(dir string, fn func(name string)) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	shadow := filepath.Join(c.root, abs)
+	if _, err := os.Stat(shadow); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(shadow, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && strings.HasSuffix(p, ".sum") {
+			rel, err := filepath.Rel(shadow, strings.TrimSuffix(p, ".sum"))
+			if err != nil {
+				return err
+			}
+			fn(filepath.Join(dir, rel))
+		}
+		return nil
+	})
+}
+
+func (shadow_cache) KeepsCtime() bool { return true }
+
+func (shadow_cache) Close() error { return nil }
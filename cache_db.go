@@ -0,0 +1,113 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var db_bucket = []byte("sums")
+
+// db_cache keeps every record in a single database file, keyed by the
+// absolute path of the file.
+type db_cache struct {
+	db *bolt.DB
+}
+
+// openDBCache opens the database, waiting a little for a run which has it
+// open to finish rather than stalling behind it.
+func openDBCache(name string) (*db_cache, error) {
+	db, err := bolt.Open(name, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("cache db %s in use by another run", name)
+	} else if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(db_bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &db_cache{db: db}, nil
+}
+
+func (c *db_cache) key(name string) []byte {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		abs = name
+	}
+	return []byte(abs)
+}
+
+func (c *db_cache) Load(name string) (sums map[string]string) {
+	c.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(db_bucket).Get(c.key(name)); data != nil {
+			sums = parseSums(data, name)
+		}
+		return nil
+	})
+	if sums == nil {
+		sums = make(map[string]string)
+	}
+	return
+}
+
+func (c *db_cache) Store(name string, sums map[string]string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db_bucket).Put(c.key(name), formatSums(sums))
+	})
+}
+
+func (c *db_cache) Remove(name string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db_bucket).Delete(c.key(name))
+	})
+}
+
+func (c *db_cache) Walk(dir string, fn func(name string)) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	prefix := strings.TrimSuffix(abs, "/") + "/"
+	var names []string
+	err = c.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(db_bucket).Cursor()
+		for k, _ := cur.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = cur.Next() {
+			names = append(names, string(k))
+		}
+		return nil
+	})
+	// Call fn outside of the transaction, so it may update the cache
+	for _, name := range names {
+		rel, _ := filepath.Rel(abs, name)
+		fn(filepath.Join(dir, rel))
+	}
+	return err
+}
+
+func (c *db_cache) KeepsCtime() bool { return true }
+
+func (c *db_cache) Close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// The extended attribute holding the record of a file.
+const xattr_name = "user.deb-mirror-checker.sum"
+
+// xattr_cache keeps each record in an extended attribute on the file itself,
+// so it follows the file around and vanishes with it.
+type xattr_cache struct{}
+
+func (xattr_cache) Load(name string) map[string]string {
+	buf := make([]byte, 4096)
+	n, err := unix.Getxattr(name, xattr_name, buf)
+	if err != nil {
+		return make(map[string]string)
+	}
+	return parseSums(buf[:n], name)
+}
+
+func (xattr_cache) Store(name string, sums map[string]string) error {
+	return unix.Setxattr(name, xattr_name, formatSums(sums), 0)
+}
+
+func (xattr_cache) Remove(name string) error {
+	return unix.Removexattr(name, xattr_name)
+}
+
+func (xattr_cache) Walk(dir string, fn func(name string)) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			if _, err := unix.Getxattr(p, xattr_name, nil); err == nil {
+				fn(p)
+			}
+		}
+		return nil
+	})
+}
+
+// Setting the attribute changes the ctime of the file, so it cannot be
+// recorded.
+func (xattr_cache) KeepsCtime() bool { return false }
+
+func (xattr_cache) Close() error { return nil }
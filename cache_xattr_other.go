@@ -0,0 +1,32 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+var errNoXattr = errors.New("extended attributes are not supported on this platform")
+
+// xattr_cache is unavailable on this platform, every store fails.
+type xattr_cache struct{}
+
+func (xattr_cache) Load(name string) map[string]string              { return make(map[string]string) }
+func (xattr_cache) Store(name string, sums map[string]string) error { return errNoXattr }
+func (xattr_cache) Remove(name string) error                        { return errNoXattr }
+func (xattr_cache) Walk(dir string, fn func(name string)) error     { return errNoXattr }
+func (xattr_cache) KeepsCtime() bool                                { return false }
+func (xattr_cache) Close() error                                    { return nil }
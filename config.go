@@ -0,0 +1,179 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A mirror_config is a [mirror.NAME] table of the -config file, describing
+// what the run command audits.  Root is relative to -root, like the other
+// repo paths.  Keyrings default to the -keyring option and the policy fields
+// (fail-on, max-age and state) to the global ones.
+type mirror_config struct {
+	Root          string   `toml:"root"`
+	Suites        []string `toml:"suites"`
+	Components    []string `toml:"components"`
+	Architectures []string `toml:"architectures"`
+	Keyrings      []string `toml:"keyrings"`
+	Signers       []string `toml:"signers"`
+	MinSignatures int      `toml:"min-signatures"`
+	FailOn        string   `toml:"fail-on"`
+	MaxAge        string   `toml:"max-age"`
+	State         string   `toml:"state"`
+}
+
+// The mirrors in the -config file, by name.
+var mirrors = make(map[string]mirror_config)
+
+// loadConfig sets the global options from a TOML file, keyed by option name,
+// and reads the signer policies and mirrors described in it, such as:
+//
+//	root = "/srv/mirror/debian"
+//	keyring = ["/usr/share/keyrings/debian-archive-keyring.gpg"]
+//	fail-on = "all"
+//
+//	[[policy]]
+//	origin = "Debian"
+//	signers = ["4D64FEC119C2029067D6E791F8D2585B8783D481", ...]
+//	min-signatures = 2
+//
+//	[mirror.debian]
+//	root = "/srv/mirror/debian"
+//	suites = ["bookworm", "bookworm-updates"]
+//
+// Options given on the command line, listed in set, are left alone.
+func loadConfig(name string, set map[string]bool) error {
+	var conf map[string]interface{}
+	if _, err := toml.DecodeFile(name, &conf); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(conf))
+	for k := range conf {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "mirror" || k == "policy" {
+			continue
+		}
+		f := flag.Lookup(k)
+		if f == nil || k == "config" {
+			return fmt.Errorf("%s: unknown option %q", name, k)
+		}
+		if set[k] {
+			continue
+		}
+		values, ok := conf[k].([]interface{})
+		if !ok {
+			values = []interface{}{conf[k]}
+		}
+		for _, v := range values {
+			if err := f.Value.Set(fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: option %q: %v", name, k, err)
+			}
+		}
+	}
+
+	var mirror_conf struct {
+		Policy []signer_policy          `toml:"policy"`
+		Mirror map[string]mirror_config `toml:"mirror"`
+	}
+	md, err := toml.DecodeFile(name, &mirror_conf)
+	if err != nil {
+		return err
+	}
+	for _, key := range md.Undecoded() {
+		if len(key) > 1 && (key[0] == "mirror" || key[0] == "policy") {
+			return fmt.Errorf("%s: unknown %s setting %q", name, key[0], key.String())
+		}
+	}
+	for _, p := range mirror_conf.Policy {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		policies = append(policies, p)
+	}
+	for mirror_name, m := range mirror_conf.Mirror {
+		if m.Root == "" {
+			return fmt.Errorf("%s: mirror %q has no root", name, mirror_name)
+		}
+		if _, err := parseFailOn(m.FailOn); err != nil {
+			return fmt.Errorf("%s: mirror %q: %v", name, mirror_name, err)
+		}
+		policy := signer_policy{Name: mirror_name, Signers: m.Signers, MinSignatures: m.MinSignatures}
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("%s: mirror %v", name, err)
+		}
+		if m.MaxAge != "" {
+			if _, err := time.ParseDuration(m.MaxAge); err != nil {
+				return fmt.Errorf("%s: mirror %q: max-age: %v", name, mirror_name, err)
+			}
+		}
+		mirrors[mirror_name] = m
+	}
+	return nil
+}
+
+// runMirror audits a mirror from the config with its own keyrings, scope
+// and policy.
+func runMirror(name string, m mirror_config) {
+	out.Println("Mirror", name)
+
+	// The policy of the mirror applies to its records only
+	if m.FailOn != "" {
+		mask, _ := parseFailOn(m.FailOn)
+		defer out.Policy(out.Policy(mask))
+	}
+	if m.MaxAge != "" {
+		defer func(old time.Duration) { max_age = old }(max_age)
+		max_age, _ = time.ParseDuration(m.MaxAge)
+	}
+	if m.State != "" {
+		defer func(old string) { state_file = old }(state_file)
+		state_file = localPath(m.State)
+	}
+
+	names := m.Keyrings
+	if len(names) == 0 {
+		names = keyrings
+	}
+	if len(names) == 0 {
+		out.Setup(name, fmt.Errorf("mirror %q has no keyrings", name))
+		return
+	}
+	var paths []string
+	for _, keyring := range names {
+		paths = append(paths, localPath(keyring))
+	}
+	keyring, err := loadKeyrings(paths)
+	if err != nil {
+		out.Setup(strings.Join(paths, ","), err)
+		return
+	}
+
+	out.Error(m.Root, audit(m.Root, keyring, &audit_scope{
+		suites:     m.Suites,
+		components: m.Components,
+		archs:      m.Architectures,
+		policy:     &signer_policy{Name: name, Signers: m.Signers, MinSignatures: m.MinSignatures},
+	}))
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A field is a single "Name: value" entry of a control file stanza.  Any
+// continuation lines are kept in Lines with their leading whitespace removed.
+type field struct {
+	Name  string
+	Value string
+	Lines []string
+	Line  int
+}
+
+// A stanza is one paragraph of a deb822 control file (Packages, Sources,
+// Release, .dsc, .changes, ...) with the fields kept in the order read.
+type stanza struct {
+	Fields []field
+	Line   int
+}
+
+// field returns the named field, field names are matched case-insensitively.
+func (s *stanza) field(name string) *field {
+	for i := range s.Fields {
+		if strings.EqualFold(s.Fields[i].Name, name) {
+			return &s.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Has reports whether the stanza contains the named field.
+func (s *stanza) Has(name string) bool {
+	return s.field(name) != nil
+}
+
+// Get returns the value on the first line of the named field.
+func (s *stanza) Get(name string) string {
+	if f := s.field(name); f != nil {
+		return f.Value
+	}
+	return ""
+}
+
+// Lines returns the continuation lines of a multi-line field, such as the
+// checksum lists in Release and Sources files.
+func (s *stanza) Lines(name string) []string {
+	if f := s.field(name); f != nil {
+		return f.Lines
+	}
+	return nil
+}
+
+type stanzaReader struct {
+	scanner *bufio.Scanner
+	name    string
+	line    int
+	signed  bool
+	done    bool
+}
+
+// newStanzaReader reads deb822 paragraphs from r, name is only used to give
+// errors a "file:line:" prefix.  A cleartext PGP wrapper, as found around
+// .dsc and .changes files, is skipped over.
+func newStanzaReader(r io.Reader, name string) *stanzaReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	return &stanzaReader{scanner: scanner, name: name}
+}
+
+func (r *stanzaReader) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", r.name, r.line, fmt.Sprintf(format, a...))
+}
+
+// Next returns the next stanza or io.EOF once the input is exhausted.  The
+// final stanza is returned even when the input lacks a trailing blank line.
+func (r *stanzaReader) Next() (*stanza, error) {
+	var s *stanza
+	for !r.done && r.scanner.Scan() {
+		r.line++
+		line := r.scanner.Text()
+
+		switch {
+		case line == "-----BEGIN PGP SIGNED MESSAGE-----":
+			if s != nil {
+				return nil, r.errorf("unexpected PGP header inside a stanza")
+			}
+			// Skip the armor headers up to the first blank line
+			r.signed = true
+			for r.scanner.Scan() {
+				r.line++
+				if strings.TrimSpace(r.scanner.Text()) == "" {
+					break
+				}
+			}
+			continue
+		case line == "-----BEGIN PGP SIGNATURE-----":
+			r.done = true
+			continue
+		case r.signed && strings.HasPrefix(line, "- "):
+			line = line[2:]
+		}
+
+		if strings.TrimSpace(line) == "" {
+			if s != nil {
+				return s, nil
+			}
+			continue
+		}
+		if line[0] == '#' {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if s == nil || len(s.Fields) == 0 {
+				return nil, r.errorf("continuation line without a field")
+			}
+			f := &s.Fields[len(s.Fields)-1]
+			f.Lines = append(f.Lines, strings.TrimSpace(line))
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, r.errorf("invalid line %q", line)
+		}
+		if s == nil {
+			s = &stanza{Line: r.line}
+		}
+		s.Fields = append(s.Fields, field{
+			Name:  line[:i],
+			Value: strings.TrimSpace(line[i+1:]),
+			Line:  r.line,
+		})
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, r.errorf("%v", err)
+	}
+	if s != nil {
+		return s, nil
+	}
+	return nil, io.EOF
+}
+
+// readStanzas calls fn on every stanza read from r, stopping at the first
+// error returned from either the parser or fn.
+func readStanzas(r io.Reader, name string, fn func(*stanza) error) error {
+	sr := newStanzaReader(r, name)
+	for {
+		s, err := sr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(s); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStanzaReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string // the Package field of each stanza
+		last  []string // the continuation lines of the last stanza's Files
+	}{
+		{name: "trailing blank line", input: "Package: a\n\nPackage: b\n\n", want: []string{"a", "b"}},
+		{name: "no trailing blank line", input: "Package: a\n\nPackage: b\n", want: []string{"a", "b"}},
+		{name: "no final line break", input: "Package: a\n\n\nPackage: b", want: []string{"a", "b"}},
+		{name: "final continuation", input: "Package: a\nFiles:\n x 1 a\n y 2 b", want: []string{"a"},
+			last: []string{"x 1 a", "y 2 b"}},
+		{name: "signed", input: "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\nPackage: a\n" +
+			"Files:\n x 1 a\n-----BEGIN PGP SIGNATURE-----\n\nabc\n-----END PGP SIGNATURE-----\n",
+			want: []string{"a"}, last: []string{"x 1 a"}},
+	}
+	for _, tt := range tests {
+		r := newStanzaReader(strings.NewReader(tt.input), tt.name)
+		var got []string
+		var last *stanza
+		for {
+			s, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			got, last = append(got, s.Get("Package")), s
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.last != nil && (last == nil || !reflect.DeepEqual(last.Lines("Files"), tt.last)) {
+			t.Errorf("%s: last Files %v, want %q", tt.name, last, tt.last)
+		}
+	}
+}
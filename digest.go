@@ -0,0 +1,150 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// The digests which can be recorded in a .sum file, named as in the Packages
+// fields and listed in the order they are written, with their collision
+// resistance in bits.  SHA3-256 and BLAKE2b are not used by Debian but are
+// available for local manifests.
+var digests = []struct {
+	name string
+	new  func() hash.Hash
+	bits int
+}{
+	{"MD5sum", md5.New, 64},
+	{"SHA1", sha1.New, 80},
+	{"SHA256", sha256.New, 128},
+	{"SHA512", sha512.New, 256},
+	{"SHA3-256", sha3.New256, 128},
+	{"BLAKE2b", func() hash.Hash { h, _ := blake2b.New512(nil); return h }, 256},
+}
+
+// The collision resistance of the hashes a signature may be made with.
+var signature_hash_bits = map[crypto.Hash]int{
+	crypto.MD5:       64,
+	crypto.SHA1:      80,
+	crypto.RIPEMD160: 80,
+	crypto.SHA224:    112,
+	crypto.SHA256:    128,
+	crypto.SHA384:    192,
+	crypto.SHA512:    256,
+	crypto.SHA3_256:  128,
+	crypto.SHA3_512:  256,
+}
+
+// The weakest digest counted when checking files and allowed for signatures,
+// empty for any, and the shortest RSA key allowed to sign, set from the
+// -min-digest, -min-rsa-bits and -fips options.
+var (
+	min_digest   string
+	min_rsa_bits int
+)
+
+// setCryptoPolicy checks and applies the -min-digest, -min-rsa-bits and
+// -fips options, -fips only filling in those not given.
+func setCryptoPolicy(digest string, rsa_bits int, fips bool) error {
+	if fips {
+		if digest == "" {
+			digest = "SHA256"
+		}
+		if rsa_bits == 0 {
+			rsa_bits = 2048
+		}
+	}
+	min_digest, min_rsa_bits = "", rsa_bits
+	if digest == "" {
+		return nil
+	}
+	for _, d := range digests {
+		if strings.EqualFold(d.name, digest) {
+			min_digest = d.name
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown -min-digest %q", digest)
+}
+
+// digestBits returns the collision resistance of the named digest.
+func digestBits(name string) int {
+	for _, d := range digests {
+		if d.name == name {
+			return d.bits
+		}
+	}
+	return 0
+}
+
+// strongDigest reports whether the named digest is at least as strong as
+// -min-digest.
+func strongDigest(name string) bool {
+	return min_digest == "" || digestBits(name) >= digestBits(min_digest)
+}
+
+// strongSignatureHash reports whether a signature hash is at least as strong
+// as -min-digest.
+func strongSignatureHash(h crypto.Hash) bool {
+	return min_digest == "" || signature_hash_bits[h] >= digestBits(min_digest)
+}
+
+// newDigest returns a new hash for the named digest, or nil if it is unknown.
+func newDigest(name string) hash.Hash {
+	for _, d := range digests {
+		if d.name == name {
+			return d.new()
+		}
+	}
+	return nil
+}
+
+// parseDigests splits a comma separated list of digest names, such as the
+// -digests option.
+func parseDigests(list string) (names []string, err error) {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if newDigest(name) == nil {
+			return nil, fmt.Errorf("unknown digest %q", name)
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+// wantedDigests returns the digests named in a set of index checksums, in
+// .sum file order, so only those need computing.
+func wantedDigests(want map[string]string) (names []string) {
+	for _, d := range digests {
+		if want[d.name] != "" {
+			names = append(names, d.name)
+		}
+	}
+	return
+}
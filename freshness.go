@@ -0,0 +1,138 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/araddon/dateparse"
+)
+
+// checkFreshness guards against old but validly signed Release files being
+// replayed onto the mirror.  An expired Valid-Until or a Date older than the
+// one last recorded in the state file is an error, while a signature made in
+// the future or longer ago than max_age only warrants a warning.
+func checkFreshness(sf *signedFile) error {
+	if sf.isManifest() {
+		return nil
+	}
+	rel, err := newStanzaReader(strings.NewReader(sf.content), sf.signed).Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if v := rel.Get("Valid-Until"); v != "" {
+		valid_until, err := dateparse.ParseAny(v)
+		if err != nil {
+			return fmt.Errorf("%s: invalid Valid-Until %q", sf.signed, v)
+		}
+		if now.After(valid_until) {
+			return fmt.Errorf("%s: expired, Valid-Until %v", sf.signed, valid_until)
+		}
+	}
+
+	if sf.signed_at.After(now) {
+		out.Printf("warning: %s signature was made in the future, at %v\n", sf.name, sf.signed_at)
+	} else if max_age > 0 && now.Sub(sf.signed_at) > max_age {
+		out.Printf("warning: %s signature is older than %v, made at %v\n", sf.name, max_age, sf.signed_at)
+	}
+
+	if state_file == "" {
+		return nil
+	}
+	v := rel.Get("Date")
+	if v == "" {
+		return fmt.Errorf("%s: missing Date field", sf.signed)
+	}
+	date, err := dateparse.ParseAny(v)
+	if err != nil {
+		return fmt.Errorf("%s: invalid Date %q", sf.signed, v)
+	}
+	return checkRollback(sf.signed, date)
+}
+
+// checkRollback compares the Date of a Release with the one last seen for the
+// same suite, and records the newer date in the state file.  Suites are keyed
+// by the absolute path of their dists directory.
+func checkRollback(signed string, date time.Time) error {
+	suite, err := filepath.Abs(filepath.Dir(signed))
+	if err != nil {
+		return err
+	}
+	state, err := loadState(state_file)
+	if err != nil {
+		return err
+	}
+	if last, ok := state[suite]; ok {
+		if date.Before(last) {
+			return fmt.Errorf("%s: rollback detected, Date %v is older than the last seen %v", signed, date, last)
+		}
+		if !date.After(last) {
+			return nil
+		}
+	}
+	state[suite] = date
+	return saveState(state_file, state)
+}
+
+// loadState reads the last seen Release Date of each suite, the file is a
+// control file with one "Suite" and "Date" stanza per suite.
+func loadState(name string) (map[string]time.Time, error) {
+	state := make(map[string]time.Time)
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	err = readStanzas(file, name, func(s *stanza) error {
+		t, err := time.Parse(time.RFC1123Z, s.Get("Date"))
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid Date: %v", name, s.Line, err)
+		}
+		state[s.Get("Suite")] = t
+		return nil
+	})
+	return state, err
+}
+
+// saveState writes the state file through a temporary file so an interrupted
+// run cannot leave it truncated.
+func saveState(name string, state map[string]time.Time) error {
+	suites := make([]string, 0, len(state))
+	for suite := range state {
+		suites = append(suites, suite)
+	}
+	sort.Strings(suites)
+
+	var data bytes.Buffer
+	for _, suite := range suites {
+		fmt.Fprintf(&data, "Suite: %s\nDate: %s\n\n", suite, state[suite].UTC().Format(time.RFC1123Z))
+	}
+	return writeAtomic(name, data.Bytes())
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckFreshness(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC1123Z)
+	past := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC1123Z)
+	tests := []struct {
+		name    string
+		signed  string
+		content string
+		err     string
+	}{
+		{name: "no Valid-Until", signed: "dists/stable/InRelease", content: "Suite: stable\n"},
+		{name: "valid", signed: "dists/stable/InRelease", content: "Suite: stable\nValid-Until: " + future + "\n"},
+		{name: "expired", signed: "dists/stable/InRelease", content: "Suite: stable\nValid-Until: " + past + "\n",
+			err: "expired"},
+		{name: "invalid", signed: "dists/stable/InRelease", content: "Valid-Until: someday\n",
+			err: "invalid Valid-Until"},
+		{name: "empty", signed: "dists/stable/Release", content: ""},
+		{name: "manifest", signed: "images/SHA256SUMS", content: "Valid-Until: " + past + "\n"},
+	}
+	defer func(s string) { state_file = s }(state_file)
+	state_file = ""
+	for _, tt := range tests {
+		sf := &signedFile{name: tt.signed, signed: tt.signed, content: tt.content, signed_at: time.Now()}
+		err := checkFreshness(sf)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestCheckRollback(t *testing.T) {
+	dir := t.TempDir()
+	defer func(s string) { state_file = s }(state_file)
+	state_file = filepath.Join(dir, "mirror.state")
+
+	stable := filepath.Join(dir, "dists/stable/InRelease")
+	unstable := filepath.Join(dir, "dists/unstable/InRelease")
+	tests := []struct {
+		signed string
+		date   string
+		err    string
+	}{
+		{signed: stable, date: "Sat, 01 Jun 2024 10:00:00 +0000"},
+		{signed: stable, date: "Sat, 01 Jun 2024 10:00:00 +0000"},
+		{signed: stable, date: "Fri, 31 May 2024 10:00:00 +0000", err: "rollback detected"},
+		{signed: unstable, date: "Fri, 31 May 2024 10:00:00 +0000"},
+		{signed: stable, date: "Sun, 02 Jun 2024 10:00:00 +0000"},
+		{signed: stable, date: "Sat, 01 Jun 2024 10:00:00 +0000", err: "rollback detected"},
+		{signed: stable, err: "missing Date"},
+		{signed: stable, date: "not a date", err: "invalid Date"},
+	}
+	for i, tt := range tests {
+		content := "Suite: x\n"
+		if tt.date != "" {
+			content += "Date: " + tt.date + "\n"
+		}
+		sf := &signedFile{name: tt.signed, signed: tt.signed, content: content, signed_at: time.Now()}
+		err := checkFreshness(sf)
+		if tt.err == "" && err != nil {
+			t.Errorf("%d %s: %v", i, tt.date, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%d %s: error %v, want %q", i, tt.date, err, tt.err)
+		}
+	}
+
+	state, err := loadState(state_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		filepath.Dir(stable):   "Sun, 02 Jun 2024 10:00:00 +0000",
+		filepath.Dir(unstable): "Fri, 31 May 2024 10:00:00 +0000",
+	}
+	for suite, date := range want {
+		if got := state[suite].UTC().Format(time.RFC1123Z); got != date {
+			t.Errorf("state of %s: %s, want %s", suite, got, date)
+		}
+	}
+	if len(state) != len(want) {
+		t.Errorf("state %v, want %d suites", state, len(want))
+	}
+
+	// Only the state file is left, no temporary files
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() != "mirror.state" {
+			t.Errorf("left behind %s", e.Name())
+		}
+	}
+}
@@ -14,43 +14,9 @@
 
 package main
 
-import (
-	"bufio"
-	"fmt"
-	"os"
-	"path"
-	"strings"
-)
-
-func getSums(filename string) (sums map[string]string) {
-	sums = make(map[string]string)
-
-	dir_name, file_name := path.Split(filename)
-	sum_name := path.Join(dir_name, fmt.Sprintf(".%s.sum", file_name))
-
-	if _, err := os.Stat(sum_name); os.IsNotExist(err) {
-		processFile(filename)
-	}
-
-	sum_file, err := os.OpenFile(sum_name, os.O_RDONLY, 0666)
-	if err != nil {
-		fmt.Println("missing", filename)
-		return nil
-	}
-	defer sum_file.Close()
-
-	sum_scanner := bufio.NewScanner(sum_file)
-	var line string
-	for {
-		if sum_scanner.Scan() {
-			line = sum_scanner.Text()
-		} else {
-			break
-		}
-		parts := strings.SplitN(line, ": ", 2)
-		if len(parts) == 2 {
-			sums[parts[0]] = strings.TrimSpace(parts[1])
-		}
-	}
-	return
+// getSums returns the recorded size and digests of filename, computing any
+// of the algos which are not yet in its .sum file, or an error if it could
+// not be read.
+func getSums(filename string, algos []string, buf *hash_buf) (map[string]string, error) {
+	return processFile(filename, algos, buf)
 }
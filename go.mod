@@ -0,0 +1,17 @@
+module github.com/pschou/deb-mirror-checker
+
+go 1.22
+
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.21
+	github.com/ulikunitz/xz v0.5.12
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.16.0
+)
+
+require github.com/cloudflare/circl v1.3.7 // indirect
@@ -1,10 +1,143 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
 package main
 
-import "net/http"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The client used for every remote index and file, set up from the HTTP
+// options by setupHTTP.
+var client = &http.Client{}
+
+// The wait before the first retry of a failed request, doubled each time.
+var retry_delay = time.Second
+
+// setupHTTP configures the client with the -proxy, -ca-file, -cert, -key and
+// -timeout options.  Without -proxy the usual proxy environment variables
+// apply.
+func setupHTTP() error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *proxy_opt != "" {
+		proxy, err := url.Parse(*proxy_opt)
+		if err != nil {
+			return fmt.Errorf("bad -proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tls_config := &tls.Config{}
+	if *ca_file != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(localPath(*ca_file))
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no PEM certificates found", *ca_file)
+		}
+		tls_config.RootCAs = pool
+	}
+	if *cert_file != "" {
+		key := *key_file
+		if key == "" {
+			key = *cert_file
+		}
+		cert, err := tls.LoadX509KeyPair(localPath(*cert_file), localPath(key))
+		if err != nil {
+			return err
+		}
+		tls_config.Certificates = []tls.Certificate{cert}
+	} else if *key_file != "" {
+		return errors.New("-key needs -cert")
+	}
+	transport.TLSClientConfig = tls_config
+
+	client = &http.Client{Transport: transport, Timeout: *http_timeout}
+	return nil
+}
+
+// userAgent describes the tool to the servers it talks to.
+func userAgent() string {
+	v := version
+	if v == "" {
+		v = "dev"
+	}
+	return "deb-mirror-checker/" + v + " (+https://github.com/pschou/deb-mirror-checker)"
+}
+
+// httpGet fetches url, see httpDo.
+func httpGet(url string) (*http.Response, error) {
+	return httpDo("GET", url)
+}
+
+// httpHead asks for the headers of url, see httpDo.
+func httpHead(url string) (*http.Response, error) {
+	return httpDo("HEAD", url)
+}
 
-var client = http.Client{
-	CheckRedirect: func(r *http.Request, via []*http.Request) error {
-		r.URL.Opaque = r.URL.Path
-		return nil
-	},
+// httpDo makes a request with the credentials from the -auth files for its
+// URL, unless it has its own, retrying network errors and 5xx responses up to
+// -retries times with a doubling delay.  A response other than 2xx is
+// returned as an error, as a *url.Error like a network error, so an error
+// page is never read as an index.
+func httpDo(method, target string) (*http.Response, error) {
+	delay := retry_delay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", userAgent())
+		if req.URL.User == nil {
+			cred, err := findCredential(req.URL)
+			if err != nil {
+				return nil, err
+			}
+			if cred != nil {
+				cred.authorize(req)
+			}
+		}
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		// A certificate which does not verify will not on a retry either
+		var cert_err *tls.CertificateVerificationError
+		retry := !errors.As(err, &cert_err)
+		if err == nil {
+			resp.Body.Close()
+			retry = resp.StatusCode >= 500
+			err = &url.Error{Op: method[:1] + strings.ToLower(method[1:]), URL: req.URL.Redacted(), Err: errors.New(resp.Status)}
+		}
+		if !retry || attempt >= *http_retries {
+			return nil, err
+		}
+		out.Printf("warning: %v, retrying in %v\n", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
 }
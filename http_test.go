@@ -0,0 +1,134 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testHTTP points httpDo at a reporter writing to the returned buffer, with
+// no credentials, a short retry delay and the retries given, undoing it all
+// when the test ends.
+func testHTTP(t *testing.T, retries int) *bytes.Buffer {
+	saved_out, saved_delay, saved_retries, saved_client := out, retry_delay, *http_retries, client
+	t.Cleanup(func() {
+		out, retry_delay, *http_retries, client = saved_out, saved_delay, saved_retries, saved_client
+		credentials, credentials_err, credentials_once = nil, nil, sync.Once{}
+	})
+	buf := &bytes.Buffer{}
+	out = newReporter("text", "test")
+	out.w = buf
+	retry_delay, *http_retries, client = time.Millisecond, retries, &http.Client{}
+	credentials, credentials_err, credentials_once = nil, nil, sync.Once{}
+	credentials_once.Do(func() {})
+	return buf
+}
+
+// statusServer answers with each status in turn, then with the last one.
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&hits, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestHTTPRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		hits     int32
+		ok       bool
+	}{
+		{name: "ok", statuses: []int{200}, retries: 3, hits: 1, ok: true},
+		{name: "recovers", statuses: []int{503, 502, 200}, retries: 3, hits: 3, ok: true},
+		{name: "gives up", statuses: []int{500}, retries: 2, hits: 3},
+		{name: "no retries", statuses: []int{503, 200}, retries: 0, hits: 1},
+		{name: "not found", statuses: []int{404, 200}, retries: 3, hits: 1},
+		{name: "forbidden", statuses: []int{403, 200}, retries: 3, hits: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHTTP(t, tt.retries)
+			srv, hits := statusServer(t, tt.statuses...)
+			resp, err := httpGet(srv.URL + "/dists/stable/InRelease")
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tt.ok && err != nil {
+				t.Error(err)
+			} else if !tt.ok && err == nil {
+				t.Error("no error")
+			}
+			if got := atomic.LoadInt32(hits); got != tt.hits {
+				t.Errorf("%d requests, want %d", got, tt.hits)
+			}
+		})
+	}
+}
+
+func TestHTTPBackoff(t *testing.T) {
+	buf := testHTTP(t, 3)
+	srv, _ := statusServer(t, 500)
+	if _, err := httpGet(srv.URL); err == nil {
+		t.Fatal("no error")
+	}
+	for _, delay := range []string{"retrying in 1ms", "retrying in 2ms", "retrying in 4ms"} {
+		if !strings.Contains(buf.String(), delay) {
+			t.Errorf("no %q in output:\n%s", delay, buf)
+		}
+	}
+}
+
+func TestHTTPNetworkError(t *testing.T) {
+	buf := testHTTP(t, 2)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	if _, err := httpGet(srv.URL); err == nil {
+		t.Fatal("no error")
+	}
+	if n := strings.Count(buf.String(), "retrying"); n != 2 {
+		t.Errorf("%d retries, want 2", n)
+	}
+}
+
+func TestHTTPCertificateError(t *testing.T) {
+	buf := testHTTP(t, 3)
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	if _, err := httpGet(srv.URL); err == nil {
+		t.Fatal("no error from an untrusted certificate")
+	}
+	if strings.Contains(buf.String(), "retrying") {
+		t.Errorf("retried a certificate error:\n%s", buf)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// An indexFile is one repo file referenced by a Packages or Sources stanza,
+// with the checksums keyed by the same names used in the .sum files.
+type indexFile struct {
+	Filename string
+	Size     string
+	Sums     map[string]string
+}
+
+// The checksum fields of a Packages stanza, in the order they are checked.
+var package_sums = []string{"MD5sum", "SHA1", "SHA256", "SHA512"}
+
+// The checksum list fields of a Sources stanza and the digest each one holds.
+var source_sums = []struct{ field, digest string }{
+	{"Files", "MD5sum"},
+	{"Checksums-Sha1", "SHA1"},
+	{"Checksums-Sha256", "SHA256"},
+	{"Checksums-Sha512", "SHA512"},
+}
+
+// stanzaFiles returns the files referenced by a stanza.  A binary Packages
+// stanza has a single Filename, while a Sources stanza lists the .dsc,
+// .orig.tar.* and .debian.tar.* files found under its Directory.
+func stanzaFiles(s *stanza) (files []indexFile) {
+	if filename := s.Get("Filename"); filename != "" {
+		f := indexFile{Filename: filename, Size: s.Get("Size"), Sums: make(map[string]string)}
+		for _, k := range package_sums {
+			if v := s.Get(k); v != "" {
+				f.Sums[k] = v
+			}
+		}
+		return []indexFile{f}
+	}
+
+	dir := s.Get("Directory")
+	if dir == "" {
+		return nil
+	}
+	found := make(map[string]int)
+	for _, ss := range source_sums {
+		for _, line := range s.Lines(ss.field) {
+			parts := strings.Fields(line)
+			if len(parts) != 3 {
+				continue
+			}
+			i, ok := found[parts[2]]
+			if !ok {
+				i = len(files)
+				found[parts[2]] = i
+				files = append(files, indexFile{
+					Filename: path.Join(dir, parts[2]),
+					Size:     parts[1],
+					Sums:     make(map[string]string),
+				})
+			}
+			files[i].Sums[ss.digest] = parts[0]
+		}
+	}
+	return
+}
+
+// readIndex calls fn for every file referenced in a Packages or Sources
+// index read from r.
+func readIndex(r io.Reader, name string, fn func(indexFile)) error {
+	return readStanzas(r, name, func(s *stanza) error {
+		for _, f := range stanzaFiles(s) {
+			fn(f)
+		}
+		return nil
+	})
+}
+
+// loadIndex opens the named Packages or Sources index and calls fn for every
+// file it references.
+func loadIndex(name string, fn func(indexFile)) error {
+	zr, err, file_close := open(name)
+	if err != nil {
+		return err
+	}
+	defer file_close()
+	return readIndex(zr, name, fn)
+}
+
+// sortedKeys returns the file names of a checksum listing in sorted order.
+func sortedKeys(m map[string]map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -14,105 +14,11 @@
 
 package main
 
-import (
-	"bufio"
-	"compress/gzip"
-	"fmt"
-	"io"
-	"log"
-	"os"
-	"strings"
-
-	"github.com/ulikunitz/xz"
-)
-
 func list(name string) {
-
-	var zr io.Reader
-
-	if strings.HasPrefix(name, "http") {
-		resp, err := client.Get(name)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer resp.Body.Close()
-
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			defer gzr.Close()
-			zr = io.Reader(gzr)
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(resp.Body)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			//defer xzr.Close()
-			defer func() { xzr = nil }()
-			zr = io.Reader(xzr)
-		} else {
-			zr = resp.Body
-		}
-
-	} else {
-
-		file, err := os.OpenFile(name, os.O_RDONLY, 0666)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		defer file.Close()
-
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(file)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			defer gzr.Close()
-			zr = io.Reader(gzr)
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(file)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			//defer xzr.Close()
-			defer func() { xzr = nil }()
-			zr = io.Reader(xzr)
-		} else {
-			zr = file
-		}
-	}
-
-	scanner := bufio.NewScanner(zr)
-	var line, filename, size string
-	for {
-		if scanner.Scan() {
-			line = scanner.Text()
-		} else {
-			break
-		}
-		parts := strings.SplitN(line, ": ", 2)
-		val := ""
-		if len(parts) == 2 {
-			val = strings.TrimSpace(parts[1])
-		}
-		switch parts[0] {
-		case "Filename":
-			filename = val
-		case "Size":
-			size = val
-		case "":
-			if filename != "" {
-				fmt.Println(size, filename)
-			}
-			filename, size = "", ""
-			continue
-		}
+	err := loadIndex(name, func(f indexFile) {
+		out.Record(record{File: f.Filename, Status: "listed", Size: f.Size, Index: name})
+	})
+	if err != nil {
+		out.Error(name, err)
 	}
 }
@@ -1,55 +1,157 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"sort"
 	"strings"
 
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
 )
 
+// The extensions of the keyring files read from a keyring directory, as apt
+// does for /etc/apt/trusted.gpg.d.
+var keyring_exts = []string{".gpg", ".asc"}
+
+// loadKeys loads the public keys in keyfile, which may be a binary OpenPGP
+// keyring (as apt uses), ASCII armored key blocks one after the other, or a
+// directory of either.  In a directory unreadable keyrings are skipped with
+// a warning, as long as some key is found.
 func loadKeys(keyfile string) (keyring openpgp.EntityList, err error) {
-	var keyRingReader io.Reader
-	keyRingReader, err = os.Open(keyfile)
-	var loaded_keys openpgp.EntityList
+	fi, err := os.Stat(keyfile)
 	if err != nil {
-		fmt.Println("Error opening keyring file:", err)
-		return
+		return nil, err
+	}
+	out.Println("Loading keys from", keyfile)
+	if !fi.IsDir() {
+		if keyring, err = readKeyFile(keyfile); err != nil {
+			return nil, err
+		}
 	} else {
-		fmt.Println("Loading keys from", keyfile)
+		files, err := ioutil.ReadDir(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !f.Mode().IsRegular() || !contains(keyring_exts, path.Ext(f.Name())) {
+				continue
+			}
+			keys, err := readKeyFile(path.Join(keyfile, f.Name()))
+			if err != nil {
+				out.Println("warning:", err)
+				continue
+			}
+			keyring = appendKeys(keyring, keys)
+		}
+		if len(keyring) == 0 {
+			return nil, fmt.Errorf("%s: no keys found", keyfile)
+		}
 	}
+	for i, key := range keyring {
+		out.Printf("  %d) Loaded key %s %s\n", i+1, keyFingerprint(key), keyName(key))
+	}
+	return
+}
 
-	scanner := bufio.NewScanner(keyRingReader)
-	var line, keystr string
-	var i int
+// loadKeyrings loads every keyring in names into one list, failing if any
+// of them cannot be loaded.
+func loadKeyrings(names []string) (keyring openpgp.EntityList, err error) {
+	for _, name := range names {
+		keys, err := loadKeys(name)
+		if err != nil {
+			return nil, err
+		}
+		keyring = appendKeys(keyring, keys)
+	}
+	return
+}
+
+// appendKeys adds the keys not already in keyring, so a key found in more
+// than one keyring is only listed once.
+func appendKeys(keyring, keys openpgp.EntityList) openpgp.EntityList {
+	for _, key := range keys {
+		dup := false
+		for _, have := range keyring {
+			if keyFingerprint(have) == keyFingerprint(key) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			keyring = append(keyring, key)
+		}
+	}
+	return keyring
+}
+
+// readKeyFile reads a binary keyring, or one or more armored key blocks.
+func readKeyFile(name string) (keyring openpgp.EntityList, err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	begin := []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")
+	end := []byte("-----END PGP PUBLIC KEY BLOCK-----")
+	if !bytes.Contains(data, begin) {
+		if keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return
+	}
 	for {
-		if scanner.Scan() {
-			line = scanner.Text()
-		} else {
+		i := bytes.Index(data, begin)
+		if i < 0 {
 			break
 		}
-		keystr += line + "\n"
-		if strings.TrimSpace(line) == "-----END PGP PUBLIC KEY BLOCK-----" {
-			i++
-			loaded_keys, err = openpgp.ReadArmoredKeyRing(strings.NewReader(keystr))
-			if err == nil {
-				for _, key := range loaded_keys {
-					keyring = append(keyring, key)
-					fmt.Printf("  %d) Loaded KeyID: 0x%02X\n", i, key.PrimaryKey.KeyId)
-				}
-				keystr = ""
-			} else {
-				fmt.Printf("  %d) Invalid key: %g\n", i, err)
-			}
+		j := bytes.Index(data[i:], end)
+		if j < 0 {
+			return nil, fmt.Errorf("%s: unterminated key block", name)
 		}
-		if len(keyring) > 0 {
-			err = nil
+		j += i + len(end)
+		keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data[i:j]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
 		}
+		keyring = append(keyring, keys...)
+		data = data[j:]
 	}
-	//for _, entity := range []*openpgp.Entity(keyring) {
-	//	fmt.Printf("Loaded KeyID: 0x%02X\n", entity.PrimaryKey.KeyId)
-	//}
 	return
 }
+
+// keyFingerprint returns the full fingerprint of the primary key of e.
+func keyFingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// keyName returns the primary user ID of e, or the first in sort order.
+func keyName(e *openpgp.Entity) string {
+	var names []string
+	for name, id := range e.Identities {
+		if id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil && *id.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(names[0])
+}
@@ -15,83 +15,465 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/araddon/dateparse"
 )
 
 var version = ""
 
-func main() {
-	var exitcode int
-	if len(os.Args) > 1 && os.Args[1] == "make" {
-		for _, name := range os.Args[2:] {
-			process(name)
-		}
-	} else if len(os.Args) > 1 && os.Args[1] == "check" {
-		for _, name := range os.Args[2:] {
-			err := parse(name)
+// The global options, which may be given before or after the command or be
+// set in the -config file.
+var (
+	root_dir       = flag.String("root", ".", "Repo base directory, the indexes and pool files named are relative to it")
+	jobs           = flag.Int("jobs", runtime.NumCPU(), "Number of files to hash at the same time")
+	format_opt     = flag.String("format", "text", "Output format: text, json or ndjson (one JSON record per line)")
+	quiet          = flag.Bool("quiet", false, "Only print problems, no progress lines or warnings")
+	config_file    = flag.String("config", "", "TOML file setting defaults for these options, keyed by option name")
+	cache_opt      = flag.String("cache", "dotfile", "Where checksums are cached: dotfile, shadow:DIR, xattr or db:FILE")
+	fail_on        = flag.String("fail-on", "mismatch,signature,unreadable", "Problems which set the exit code: mismatch, missing, signature, unreadable or all")
+	min_digest_opt = flag.String("min-digest", "", "Ignore weaker digests, such as MD5sum and SHA1 for SHA256, failing files and signatures with none as strong")
+	min_rsa_opt    = flag.Int("min-rsa-bits", 0, "Reject signatures made by shorter RSA keys")
+	fips           = flag.Bool("fips", false, "FIPS style policy, the same as -min-digest SHA256 -min-rsa-bits 2048")
+	proxy_opt      = flag.String("proxy", "", "HTTP proxy URL for remote indexes and files, by default from $http_proxy and $https_proxy")
+	ca_file        = flag.String("ca-file", "", "PEM file of CA certificates trusted for HTTPS along with the system ones")
+	cert_file      = flag.String("cert", "", "PEM client certificate for HTTPS servers which require one")
+	key_file       = flag.String("key", "", "PEM private key of -cert, when not in the same file")
+	http_timeout   = flag.Duration("timeout", 2*time.Minute, "Time limit for each HTTP request, including reading the response")
+	http_retries   = flag.Int("retries", 3, "Times to retry an HTTP request after a network error or 5xx response, waiting twice as long each time")
+	auth_http      = flag.Bool("auth-http", false, "Also send the credentials of a netrc default entry over plain http")
+	keyrings       string_list
+	auth_files     string_list
+	max_age        time.Duration
+	state_file     string
+)
+
+func init() {
+	flag.Var(&keyrings, "keyring", "PGP keyring to verify signatures with, may be repeated")
+	flag.DurationVar(&max_age, "max-age", 0, "Warn when a Release signature is older than this, such as 168h")
+	flag.StringVar(&state_file, "state", "", "File recording the last seen Release Date per suite, used to detect rollbacks")
+	flag.Var(&auth_files, "auth", "netrc or apt auth.conf file, or directory of them, with HTTP credentials, may be repeated (default $NETRC or ~/.netrc, /etc/apt/auth.conf and /etc/apt/auth.conf.d)")
+}
+
+// A string_list is an option which may be repeated.
+type string_list []string
+
+func (l *string_list) String() string { return strings.Join(*l, ",") }
+
+func (l *string_list) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// The options of single commands.
+var (
+	digest_opt  string
+	gc          bool
+	concurrency int
+	rate        float64
+)
+
+// The digests make records, from the -digests option.
+var make_digests []string
+
+// The directory the tool was started in, as the paths of keyrings and state
+// files are relative to it rather than to -root.
+var start_dir string
+
+// errUsage is returned by a command given the wrong arguments.
+var errUsage = errors.New("usage error")
+
+// A command is one of the sub commands.  flags adds its options to the
+// command's flag set, run is called with the arguments left after them.
+type command struct {
+	name  string
+	args  string
+	help  string
+	notes string
+	min   int
+	flags func(fs *flag.FlagSet)
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{
+		name: "added", args: "OLD NEW", min: 2,
+		help: "Compare two \"Packages\" and list files added with their size",
+		run: func(args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			added(args[0], args[1])
+			return nil
+		},
+	},
+	{
+		name: "audit", args: "[KEYRING] [repo_root...]",
+		help:  "Verify every dists/*/InRelease, the indexes they sign and the pool files in them",
+		notes: "KEYRING is only given when there is no -keyring option, the repo_root defaults to -root.",
+		run: func(args []string) error {
+			keyring, roots, err := commandKeyring(args)
 			if err != nil {
-				exitcode = 1
+				return err
 			}
-		}
-	} else if len(os.Args) > 2 && os.Args[1] == "verify" {
-		keyRing, err := loadKeys(os.Args[2])
-		if err != nil {
-			fmt.Println("Error opening keyring file:", err)
-			for _, name := range os.Args[3:] {
-				verify(name, nil)
-			}
-			os.Exit(1)
-		}
-		for _, name := range os.Args[3:] {
-			err := verify(name, keyRing)
+			if keyring == nil {
+				return nil
+			}
+			if len(roots) == 0 {
+				roots = []string{"."}
+			}
+			for _, root := range roots {
+				out.Error(root, audit(root, keyring, nil))
+			}
+			out.PrintSummary()
+			return nil
+		},
+	},
+	{
+		name: "check", args: "[index...]",
+		help: "Use \"Packages\" to validate checksums of all the local repo files",
+		run: func(args []string) error {
+			for _, name := range args {
+				out.Error(name, parse(name))
+			}
+			out.PrintSummary()
+			return nil
+		},
+	},
+	{
+		name: "list", args: "[index...]",
+		help: "Use \"Packages\" and dump out a list of repo files and their size",
+		run: func(args []string) error {
+			for _, name := range args {
+				list(name)
+			}
+			return nil
+		},
+	},
+	{
+		name: "make", args: "[path...]",
+		help: "Generate all the .sum files in a directory, or with -gc remove orphaned ones",
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&gc, "gc", false, "Remove .sum files whose file no longer exists instead of hashing")
+			fs.StringVar(&digest_opt, "digests", "MD5sum,SHA1,SHA256,SHA512", "Digests to record in the .sum files, also SHA3-256 and BLAKE2b")
+		},
+		run: func(args []string) (err error) {
+			if gc {
+				for _, name := range args {
+					gcSums(name)
+				}
+				return nil
+			}
+			if make_digests, err = parseDigests(digest_opt); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				return errUsage
+			}
+			p := newPipeline(*jobs)
+			for _, name := range args {
+				process(name, p)
+			}
+			p.Wait()
+			return nil
+		},
+	},
+	{
+		name: "migrate-cache", args: "FROM TO [path...]", min: 2,
+		help: "Move the cached checksums of the files under path between caches",
+		run: func(args []string) error {
+			// Moving records onto themselves would store and then remove
+			// each one
+			if sameCache(args[0], args[1]) {
+				fmt.Fprintln(os.Stderr, "error: FROM and TO are the same cache")
+				return errUsage
+			}
+			from, err := openMigrateCache(args[0])
 			if err != nil {
-				fmt.Println("error:", err)
-				exitcode = 1
+				fmt.Fprintln(os.Stderr, "error:", err)
+				return errUsage
 			}
+			defer from.Close()
+			to, err := openMigrateCache(args[1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				return errUsage
+			}
+			defer to.Close()
+			count := 0
+			for _, name := range args[2:] {
+				count += migrateSums(name, from, to)
+			}
+			out.Println("Migrated:", count)
+			out.Total("migrated", uint64(count))
+			return nil
+		},
+	},
+	{
+		name: "mtime", args: "DATE BASEURL [index...]", min: 2,
+		help: "Use \"Packages\" and dump out a list of remote files and their size modified after date",
+		flags: func(fs *flag.FlagSet) {
+			fs.IntVar(&concurrency, "concurrency", 8, "Number of HEAD requests in flight at the same time")
+			fs.Float64Var(&rate, "rate", 0, "Most HEAD requests to start per second, 0 for no limit")
+		},
+		run: func(args []string) error {
+			t, err := dateparse.ParseAny(args[0])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				return errUsage
+			}
+			url := strings.TrimSuffix(args[1], "/") + "/"
+			for _, name := range args[2:] {
+				mtime(name, t, url)
+			}
+			return nil
+		},
+	},
+	{
+		name: "run", args: "[mirror...]",
+		help: "Audit the mirrors described in the -config file, or only those named",
+		notes: "Each [mirror.NAME] table of the config sets the root, suites, components, architectures, keyrings,\n" +
+			"allowed signer fingerprints and the fail-on, max-age and state policy of its audit.",
+		run: func(args []string) error {
+			if len(mirrors) == 0 {
+				fmt.Fprintln(os.Stderr, "error: no mirrors, give a -config file with [mirror.NAME] tables")
+				return errUsage
+			}
+			names := args
+			if len(names) == 0 {
+				for name := range mirrors {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+			}
+			for _, name := range names {
+				m, ok := mirrors[name]
+				if !ok {
+					fmt.Fprintf(os.Stderr, "error: no mirror %q in %s\n", name, *config_file)
+					return errUsage
+				}
+				runMirror(name, m)
+			}
+			out.PrintSummary()
+			return nil
+		},
+	},
+	{
+		name: "sum", args: "[index...]",
+		help: "Use \"Packages\" and total the number unique files and their size",
+		run: func(args []string) error {
+			pb := &sum_passback{file_sizes: make(map[string]string)}
+			for _, name := range args {
+				sum(name, pb)
+			}
+			out.Println("Files:", pb.count)
+			out.Println("Total size:", pb.total)
+			out.Total("files", uint64(pb.count))
+			out.Total("size", pb.total)
+			return nil
+		},
+	},
+	{
+		name: "verify", args: "[KEYRING] [pgp_file...]",
+		help: "Verify PGP signature either attached or detached and validate checksums",
+		notes: "KEYRING is only given when there is no -keyring option.  A detached .gpg, .asc or .sig (armored or\n" +
+			"binary) must have the signed file in the same directory without the extension, a Release may be\n" +
+			"given for Release.gpg.",
+		run: func(args []string) error {
+			keyring, files, err := commandKeyring(args)
+			if err != nil {
+				return err
+			}
+			if keyring == nil {
+				// Without a keyring only show who signed the files
+				for _, name := range files {
+					verify(name, nil)
+				}
+				return nil
+			}
+			for _, name := range files {
+				out.Error(name, verify(name, keyring))
+			}
+			out.PrintSummary()
+			return nil
+		},
+	},
+}
+
+func main() {
+	start_dir, _ = os.Getwd()
+	name := filepath.Base(os.Args[0])
+	flag.CommandLine.Init(name, flag.ContinueOnError)
+	flag.CommandLine.SetOutput(os.Stderr)
+	flag.Usage = func() { usage(name) }
+	if err := flag.CommandLine.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(exit_usage)
+	}
+	if flag.NArg() == 0 {
+		usage(name)
+		os.Exit(exit_usage)
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			cmd = &commands[i]
 		}
-	} else if len(os.Args) > 1 && os.Args[1] == "list" {
-		for _, name := range os.Args[2:] {
-			list(name)
-		}
-	} else if len(os.Args) > 1 && os.Args[1] == "sum" {
-		pb := &sum_passback{file_sizes: make(map[string]string)}
-		for _, name := range os.Args[2:] {
-			sum(name, pb)
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "error: unknown command %q, see %s -help\n", flag.Arg(0), name)
+		os.Exit(exit_usage)
+	}
+
+	// The command's own options come first, then the global ones so they may
+	// also be given after the command.
+	fs := flag.NewFlagSet(name+" "+cmd.name, flag.ContinueOnError)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() { commandUsage(name, cmd, fs) }
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if err := fs.Parse(flag.Args()[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(exit_usage)
+	}
+
+	if *config_file != "" {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if err := loadConfig(*config_file, set); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(exit_usage)
 		}
-		fmt.Println("Files:", pb.count)
-		fmt.Println("Total size:", pb.total)
-	} else if len(os.Args) == 4 && os.Args[1] == "added" {
-		added(os.Args[2], os.Args[3])
-	} else if len(os.Args) > 3 && os.Args[1] == "mtime" {
-		t, err := dateparse.ParseAny(os.Args[2])
-		if err != nil {
-			log.Fatal(err)
+	}
+
+	var err error
+	if out, err = openReporter(*format_opt, cmd.name, *quiet); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exit_usage)
+	}
+	fail_mask, err := parseFailOn(*fail_on)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exit_usage)
+	}
+	out.Policy(fail_mask)
+	if err = setCryptoPolicy(*min_digest_opt, *min_rsa_opt, *fips); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exit_usage)
+	}
+	if err = setupHTTP(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exit_usage)
+	}
+	if cache, err = openCache(*cache_opt); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exit_usage)
+	}
+	if state_file != "" {
+		state_file = localPath(state_file)
+	}
+	if err = os.Chdir(*root_dir); err != nil {
+		out.Setup(*root_dir, err)
+		exit(out.ExitCode())
+	}
+
+	if fs.NArg() < cmd.min {
+		fs.Usage()
+		exit(exit_usage)
+	}
+	if err = cmd.run(fs.Args()); err == errUsage {
+		fs.Usage()
+		exit(exit_usage)
+	}
+	exit(out.ExitCode())
+}
+
+// commandKeyring loads the -keyring files, or when there are none the
+// keyring named by the first argument, and returns the other arguments.  A
+// keyring which cannot be loaded is recorded as a setup failure and a nil
+// keyring returned.
+func commandKeyring(args []string) (keyring openpgp.EntityList, rest []string, err error) {
+	names := keyrings
+	if len(names) == 0 {
+		if len(args) == 0 {
+			return nil, nil, errUsage
 		}
-		url := strings.TrimSuffix(os.Args[3], "/") + "/"
-		for _, name := range os.Args[4:] {
-			mtime(name, t, url)
+		names, args = args[:1], args[1:]
+	}
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, localPath(name))
+	}
+	keyring, err = loadKeyrings(paths)
+	if err != nil {
+		out.Setup(strings.Join(names, ","), err)
+		return nil, args, nil
+	}
+	return keyring, args, nil
+}
+
+// localPath returns name relative to the directory the tool was started in.
+func localPath(name string) string {
+	if filepath.IsAbs(name) || start_dir == "" {
+		return name
+	}
+	return filepath.Join(start_dir, name)
+}
+
+// usage prints the commands and the global options.
+func usage(name string) {
+	fmt.Printf("Debian mirror checker, written by Paul Schou gitlab.com/pschou/deb-mirror-checker (version: %s)\n\n", version)
+	fmt.Printf("Usage: %s [options] command [command options] [args...]\n\nCommands:\n", name)
+	for _, cmd := range commands {
+		fmt.Printf("  %-38s - %s\n", cmd.name+" "+cmd.args, cmd.help)
+	}
+	fmt.Println("\nOptions:")
+	flag.CommandLine.SetOutput(os.Stdout)
+	flag.PrintDefaults()
+	fmt.Printf("\nRun \"%s command -help\" for the options of a command.\n", name)
+	fmt.Println("Indexes, pool files and repo paths are relative to -root, keyring, state and certificate files to the current directory.")
+	fmt.Println("With -format json or ndjson each file checked is written as a JSON record, followed by a summary.")
+	fmt.Println("Any \"Packages\" argument may also be a \"Sources\" index, in which case the .dsc and source tarballs are used.")
+	fmt.Println("Packages can be also provided in .gz, .xz, .bz2, .lzma, .zst or .lz4 formats and the file can be a local file, \"-\" for stdin, or a file:// or http(s) URL endpoint.")
+	fmt.Println("The exit code adds up 1 for a checksum mismatch, 2 for missing files, 4 for a bad signature and 8 for an unreadable")
+	fmt.Println("file or index, limited to the kinds given to -fail-on, or is 64 for a usage error.")
+}
+
+// commandUsage prints the help of a command and its own options.
+func commandUsage(name string, cmd *command, fs *flag.FlagSet) {
+	fmt.Printf("Usage: %s [options] %s [options] %s\n\n%s\n", name, cmd.name, cmd.args, cmd.help)
+	if cmd.notes != "" {
+		fmt.Printf("\n%s\n", cmd.notes)
+	}
+	own := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.VisitAll(func(f *flag.Flag) {
+		if flag.Lookup(f.Name) == nil {
+			own.Var(f.Value, f.Name, f.Usage)
+			own.Lookup(f.Name).DefValue = f.DefValue
 		}
-	} else {
-		dir, _ := os.Getwd()
-		fmt.Printf("Debian mirror checker, written by Paul Schou gitlab.com/pschou/deb-mirror-checker (version: %s)\n\n", version)
-		fmt.Println("Usage:\n",
-			" added [package_old] [package_new] - Compare two \"Packages\" and list files added with their size.\n",
-			" check [package...]                - Use \"Packages\" to validate checksums of all the local repo files\n",
-			" verify PGP_KeyRing.pub [pgp_file...] - Verify PGP armored signature either attached or detached and validate checksums\n",
-			"                                        The .pgp file must have the signed file in the same directory without the .pgp\n",
-			" list [package...]                 - Use \"Packages\" and dump out a list of repo files and their size\n",
-			" make [path...]                    - generate all the .sum files in a directory\n",
-			" mtime [date] [baseurl] [package...] - Use \"Packages\" and dump out a list of remote files and their size modified after date.\n",
-			" sum [package...]                  - Use \"Packages\" and total the number unique files and their size\n",
-		)
-		fmt.Printf("Note: Your current working directory, %q, must be the repo base directory.\n", dir)
-		fmt.Println("Packages can be also provided in .gz or .xz formats and the file can be a local file or a URL endpoint.")
-		return
-	}
-	os.Exit(exitcode)
+	})
+	if cmd.flags != nil {
+		fmt.Println("\nOptions:")
+		own.SetOutput(os.Stdout)
+		own.PrintDefaults()
+	}
+	fmt.Printf("\nThe global options, see %s -help, may also be given after the command.\n", name)
+}
+
+// exit writes out the closing summary and closes the cache before exiting.
+func exit(code int) {
+	out.Close(code)
+	cache.Close()
+	os.Exit(code)
 }
@@ -0,0 +1,179 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// The digest names used by the BSD style ("SHA256 (file) = digest") lines of
+// a checksum manifest, when they differ from those of the .sum files.
+var manifest_digest_names = map[string]string{
+	"MD5": "MD5sum",
+}
+
+// isManifest reports whether a signed file is a checksum manifest rather than
+// a deb822 file such as a Release or .dsc: it is named like SHA256SUMS or
+// CHECKSUMS, or its first line is a checksum line.
+func (sf *signedFile) isManifest() bool {
+	base := strings.ToUpper(path.Base(sf.signed))
+	if strings.HasSuffix(base, "SUMS") || strings.HasSuffix(strings.TrimSuffix(base, path.Ext(base)), "SUMS") {
+		return true
+	}
+	for _, line := range strings.Split(sf.content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, _, _, ok := splitManifestLine(strings.TrimPrefix(line, "\\"))
+		return ok
+	}
+	return false
+}
+
+// splitManifestLine splits a coreutils checksum line, "digest  file" or
+// "digest *file", or a BSD one, "SHA256 (file) = digest" for which tag is the
+// digest named.  A leading backslash, marking an escaped file name, must have
+// been removed.
+func splitManifestLine(line string) (tag, digest, file string, ok bool) {
+	if i := strings.Index(line, " ("); i > 0 && strings.Contains(line, ") = ") {
+		j := strings.LastIndex(line, ") = ")
+		tag, file, digest = line[:i], line[i+2:j], line[j+4:]
+	} else if parts := strings.SplitN(line, " ", 2); len(parts) == 2 && len(parts[1]) > 1 &&
+		(parts[1][0] == ' ' || parts[1][0] == '*') {
+		digest, file = parts[0], parts[1][1:]
+	}
+	return tag, digest, file, file != "" && isHex(digest)
+}
+
+// The markers of the digest in a manifest name, such as SHA256SUMS or
+// B2SUMS, checked in order so that SHA3-256 is not taken for SHA256.
+var manifest_name_digests = []struct{ marker, digest string }{
+	{"B2", "BLAKE2b"},
+	{"BLAKE2", "BLAKE2b"},
+	{"SHA3-256", "SHA3-256"},
+	{"SHA3_256", "SHA3-256"},
+	{"SHA3", ""},
+	{"SHA512", "SHA512"},
+	{"SHA256", "SHA256"},
+	{"SHA1", "SHA1"},
+	{"MD5", "MD5sum"},
+}
+
+// manifestDigest works out the digest of the coreutils style lines in a
+// manifest from its name, such as SHA256SUMS, or else from the length of the
+// digest when only one digest has that length.
+func manifestDigest(name, digest string) (string, error) {
+	upper := strings.ToUpper(path.Base(name))
+	for _, d := range manifest_name_digests {
+		if strings.HasPrefix(upper, d.marker) || (len(d.marker) > 2 && strings.Contains(upper, d.marker)) {
+			if d.digest == "" {
+				return "", fmt.Errorf("unsupported digest in manifest name %s", path.Base(name))
+			}
+			return d.digest, nil
+		}
+	}
+	var found []string
+	for _, d := range digests {
+		if d.new().Size()*2 == len(digest) {
+			found = append(found, d.name)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no digest is %d hex digits long", len(digest))
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%d hex digits could be %s, name the manifest after its digest such as %sSUMS",
+		len(digest), strings.Join(found, " or "), strings.ToUpper(found[0]))
+}
+
+// manifestDigestName returns the .sum file name of a manifest digest name.
+func manifestDigestName(name string) string {
+	if n, ok := manifest_digest_names[strings.ToUpper(name)]; ok {
+		return n
+	}
+	for _, d := range digests {
+		if strings.EqualFold(d.name, name) {
+			return d.name
+		}
+	}
+	return ""
+}
+
+// isHex reports whether s is a non-empty string of hex digits.
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// manifestHashes reads a checksum manifest as written by sha256sum and
+// friends, "digest  file" or "digest *file" lines, or with their --tag
+// option, "SHA256 (file) = digest" lines, and returns the checksums keyed by
+// file name and then by the names used in the .sum files.  The file names are
+// relative to the directory of the manifest.
+func manifestHashes(r io.Reader, name string) (map[string]map[string]string, error) {
+	file_hashes := make(map[string]map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line_no := 1; scanner.Scan(); line_no++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Names with a newline or backslash are escaped, and the line marked
+		// with a leading backslash.
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+
+		tag, digest, file, ok := splitManifestLine(line)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unrecognised checksum line %q", name, line_no, line)
+		}
+		var algo string
+		var err error
+		if tag != "" {
+			if algo = manifestDigestName(tag); algo == "" {
+				return nil, fmt.Errorf("%s:%d: unknown digest %q", name, line_no, tag)
+			}
+		} else if algo, err = manifestDigest(name, digest); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line_no, err)
+		}
+		if h := newDigest(algo); h == nil || h.Size()*2 != len(digest) {
+			return nil, fmt.Errorf("%s:%d: %s digest of %d hex digits", name, line_no, algo, len(digest))
+		}
+		if escaped {
+			file = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(file)
+		}
+		if _, ok := file_hashes[file]; !ok {
+			file_hashes[file] = make(map[string]string)
+		}
+		file_hashes[file][algo] = strings.ToLower(digest)
+	}
+	return file_hashes, scanner.Err()
+}
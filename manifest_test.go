@@ -0,0 +1,101 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifestHashes(t *testing.T) {
+	const (
+		md5_a    = "0cc175b9c0f1b6a831c399e269772661"
+		sha1_a   = "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8"
+		sha256_a = "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"
+	)
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]map[string]string
+		err   string
+	}{
+		{name: "SHA256SUMS", input: sha256_a + "  a.iso\n" + sha256_a + " *sub/b.img\n",
+			want: map[string]map[string]string{"a.iso": {"SHA256": sha256_a}, "sub/b.img": {"SHA256": sha256_a}}},
+		{name: "MD5SUMS", input: "# comment\n\n" + strings.ToUpper(md5_a) + "  a.iso\r\n",
+			want: map[string]map[string]string{"a.iso": {"MD5sum": md5_a}}},
+		{name: "CHECKSUMS", input: md5_a + "  a.iso\n" + sha1_a + "  a.iso\n",
+			want: map[string]map[string]string{"a.iso": {"MD5sum": md5_a, "SHA1": sha1_a}}},
+		{name: "CHECKSUMS", input: sha256_a + "  a.iso\n", err: "could be SHA256 or SHA3-256"},
+		{name: "SHA256SUMS", input: md5_a + "  a.iso\n", err: "SHA256 digest of 32 hex digits"},
+		{name: "B2SUMS", input: sha256_a + sha256_a + "  a.iso\n",
+			want: map[string]map[string]string{"a.iso": {"BLAKE2b": sha256_a + sha256_a}}},
+		{name: "SHA3-256SUMS", input: sha256_a + "  a.iso\n",
+			want: map[string]map[string]string{"a.iso": {"SHA3-256": sha256_a}}},
+		{name: "SHA3-512SUMS", input: sha256_a + sha256_a + "  a.iso\n", err: "unsupported digest"},
+		{name: "CHECKSUMS", input: "SHA256 (a.iso) = " + sha256_a + "\nMD5 (a (1).iso) = " + md5_a + "\n",
+			want: map[string]map[string]string{"a.iso": {"SHA256": sha256_a}, "a (1).iso": {"MD5sum": md5_a}}},
+		{name: "CHECKSUMS", input: "WHIRLPOOL (a.iso) = " + sha256_a + "\n", err: "unknown digest"},
+		{name: "SHA256SUMS", input: "\\" + sha256_a + "  a\\nb\\\\c.iso\n",
+			want: map[string]map[string]string{"a\nb\\c.iso": {"SHA256": sha256_a}}},
+		{name: "SHA256SUMS", input: "\\SHA256 (a\\\\b.iso) = " + sha256_a + "\n",
+			want: map[string]map[string]string{"a\\b.iso": {"SHA256": sha256_a}}},
+		{name: "SHA256SUMS", input: sha256_a + " a.iso\n", err: "unrecognised checksum line"},
+		{name: "SHA256SUMS", input: "xyz  a.iso\n", err: "unrecognised checksum line"},
+	}
+	for _, tt := range tests {
+		got, err := manifestHashes(strings.NewReader(tt.input), "images/"+tt.name)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s %q: error %v, want %q", tt.name, tt.input, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.name, tt.input, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %q: got %v, want %v", tt.name, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestIsManifest(t *testing.T) {
+	const sha256_a = "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"
+	dsc := "Format: 3.0 (quilt)\nSource: hello\nChecksums-Sha256:\n " + sha256_a + " 1 hello_1.0.orig.tar.gz\n"
+	tests := []struct {
+		signed  string
+		content string
+		want    bool
+	}{
+		{"images/SHA256SUMS", "", true},
+		{"images/MD5SUMS", sha256_a + "  a.iso\n", true},
+		{"images/CHECKSUMS", "", true},
+		{"images/sha256sums.txt", "", true},
+		{"images/CLEARSUMS", sha256_a + " *a.iso\n", true},
+		{"images/CHK", "# made by sha256sum\n\n" + sha256_a + "  a.iso\n", true},
+		{"images/CHK", "\\" + sha256_a + "  a\\nb.iso\n", true},
+		{"images/CHK", "SHA256 (a.iso) = " + sha256_a + "\n", true},
+		{"dists/stable/InRelease", "Origin: Debian\nSHA256:\n " + sha256_a + " 1 main/Release\n", false},
+		{"dists/stable/Release", "", false},
+		{"pool/main/h/hello/hello_1.0.dsc", dsc, false},
+		{"pool/main/h/hello/hello_1.0_amd64.changes", "Format: 1.8\nSource: hello\n", false},
+	}
+	for _, tt := range tests {
+		sf := &signedFile{signed: tt.signed, content: tt.content}
+		if got := sf.isManifest(); got != tt.want {
+			t.Errorf("%s %q: isManifest %v, want %v", tt.signed, tt.content, got, tt.want)
+		}
+	}
+}
@@ -15,113 +15,71 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
-	"fmt"
-	"io"
-	"log"
-	"os"
-	"strings"
 	"time"
 
 	"github.com/araddon/dateparse"
-	"github.com/ulikunitz/xz"
 )
 
+// mtime lists the files of an index which the server at url reports as
+// modified after mt.  The HEAD requests run -concurrency at a time, started
+// no faster than -rate per second, and the files are listed in index order.
+// A file whose Last-Modified cannot be found is recorded as unknown rather
+// than left out.
 func mtime(name string, mt time.Time, url string) {
-
-	var zr io.Reader
-
-	if strings.HasPrefix(name, "http") {
-		resp, err := client.Get(name)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer resp.Body.Close()
-
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			defer gzr.Close()
-			zr = io.Reader(gzr)
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(resp.Body)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			//defer xzr.Close()
-			defer func() { xzr = nil }()
-			zr = io.Reader(xzr)
-		} else {
-			zr = resp.Body
+	var tick <-chan time.Time
+	if rate > 0 {
+		// A rate above 1e9 would round the interval down to nothing, which
+		// NewTicker refuses.
+		interval := time.Duration(float64(time.Second) / rate)
+		if interval < 1 {
+			interval = 1
 		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-	} else {
-
-		file, err := os.OpenFile(name, os.O_RDONLY, 0666)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		defer file.Close()
-
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(file)
-			if err != nil {
-				log.Println(err)
-				return
+	p := newPipeline(concurrency)
+	err := loadIndex(name, func(f indexFile) {
+		var rec *record
+		p.Go(func(*hash_buf) {
+			if tick != nil {
+				<-tick
 			}
-			defer gzr.Close()
-			zr = io.Reader(gzr)
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(file)
-			if err != nil {
-				log.Println(err)
-				return
+			rec = checkMtime(f, url, mt)
+		}, func() {
+			if rec != nil {
+				rec.Index = name
+				out.Record(*rec)
 			}
-			//defer xzr.Close()
-			defer func() { xzr = nil }()
-			zr = io.Reader(xzr)
-		} else {
-			zr = file
-		}
+		})
+	})
+	p.Wait()
+	if err != nil {
+		out.Error(name, err)
 	}
+}
 
-	scanner := bufio.NewScanner(zr)
-	var filename, size, line string
-	for {
-		if scanner.Scan() {
-			line = scanner.Text()
-		} else {
-			break
-		}
-		parts := strings.SplitN(line, ": ", 2)
-		val := ""
-		if len(parts) == 2 {
-			val = strings.TrimSpace(parts[1])
-		}
-		switch parts[0] {
-		case "Filename":
-			filename = val
-		case "Size":
-			size = val
-		case "":
-			if filename != "" {
-				resp, err := client.Head(url + filename)
-				modtime := resp.Header.Get("Last-Modified")
-				t, err := dateparse.ParseStrict(modtime)
-				if err == nil && t.After(mt) {
-					fmt.Println(size, filename)
-				} else {
-					//fmt.Println("skipped", size, filename, t)
-				}
-			}
-			filename, size = "", ""
-			continue
-		}
+// checkMtime asks for the Last-Modified time of a file, returning a record
+// when it is after mt or is unknown.
+func checkMtime(f indexFile, url string, mt time.Time) *record {
+	resp, err := httpHead(url + f.Filename)
+	if err != nil {
+		return &record{File: f.Filename, Status: "unreadable", Size: f.Size, Message: err.Error()}
+	}
+	resp.Body.Close()
+	modtime := resp.Header.Get("Last-Modified")
+	if modtime == "" {
+		return &record{File: f.Filename, Status: "unknown", Size: f.Size,
+			Message: redactURL(url+f.Filename) + ": no Last-Modified header"}
+	}
+	t, err := dateparse.ParseStrict(modtime)
+	if err != nil {
+		return &record{File: f.Filename, Status: "unknown", Size: f.Size,
+			Message: redactURL(url+f.Filename) + ": bad Last-Modified " + modtime}
+	}
+	if t.After(mt) {
+		return &record{File: f.Filename, Status: "modified", Size: f.Size}
 	}
+	return nil
 }
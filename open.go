@@ -1,86 +1,142 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"strings"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Magic numbers used to detect the compression of an input, lzma (alone)
+// has no magic number so it is only detected by the file suffix.
+var (
+	magic_gzip  = []byte{0x1f, 0x8b}
+	magic_xz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magic_bzip2 = []byte{'B', 'Z', 'h'}
+	magic_zstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magic_lz4   = []byte{0x04, 0x22, 0x4d, 0x18}
 )
 
+// The file suffixes of the compressed variants of an index.
+var compressed_exts = []string{".gz", ".xz", ".bz2", ".lzma", ".zst", ".lz4"}
+
+// open returns a reader for name, which may be a local file, "-" for stdin, a
+// file:// URL or an http(s) URL.  The content is decompressed when the magic
+// bytes, or failing that the name suffix, show it to be gz, xz, bz2, lzma, zst
+// or lz4 compressed.  The returned func releases the underlying resources.
 func open(name string) (io.Reader, error, func()) {
-	if strings.HasPrefix(name, "http") {
-		resp, err := client.Get(name)
+	rc, err := openRaw(name)
+	if err != nil {
+		return nil, err, func() {}
+	}
+
+	zr, zclose, err := decompress(bufio.NewReader(rc), name)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("%s: %v", name, err), func() {}
+	}
+	return zr, nil, func() {
+		zclose()
+		rc.Close()
+	}
+}
+
+// openRaw opens the undecoded byte stream for name.
+func openRaw(name string) (io.ReadCloser, error) {
+	switch {
+	case name == "-":
+		return ioutil.NopCloser(os.Stdin), nil
+	case strings.HasPrefix(name, "file://"):
+		u, err := url.Parse(name)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(u.Path)
+	case strings.HasPrefix(name, "http://"), strings.HasPrefix(name, "https://"):
+		resp, err := httpGet(name)
 		if err != nil {
-			log.Println(err)
-			return nil, err, func() {}
+			return nil, err
 		}
+		return resp.Body, nil
+	}
+	return os.Open(name)
+}
 
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				log.Println(err)
-				defer resp.Body.Close()
-				return nil, err, func() {}
-			}
-			return gzr, err, func() {
-				gzr.Close()
-				resp.Body.Close()
-			}
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(resp.Body)
-			if err != nil {
-				log.Println(err)
-				defer resp.Body.Close()
-				return nil, err, func() {}
-			}
-			return xzr, err, func() {
-				xzr = nil
-				resp.Body.Close()
-			}
-		} else {
-			return resp.Body, err, func() {
-				resp.Body.Close()
-			}
+// decompress wraps br with the decoder matching its content.
+func decompress(br *bufio.Reader, name string) (io.Reader, func(), error) {
+	head, _ := br.Peek(6)
+	codec := ""
+	switch {
+	case bytes.HasPrefix(head, magic_gzip):
+		codec = "gz"
+	case bytes.HasPrefix(head, magic_xz):
+		codec = "xz"
+	case bytes.HasPrefix(head, magic_bzip2):
+		codec = "bz2"
+	case bytes.HasPrefix(head, magic_zstd):
+		codec = "zst"
+	case bytes.HasPrefix(head, magic_lz4):
+		codec = "lz4"
+	default:
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			codec = name[i+1:]
 		}
-	} else {
+	}
 
-		file, err := os.OpenFile(name, os.O_RDONLY, 0666)
+	switch codec {
+	case "gz":
+		gzr, err := gzip.NewReader(br)
 		if err != nil {
-			log.Println(err)
-			return nil, err, func() {}
+			return nil, nil, err
 		}
-
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(file)
-			if err != nil {
-				log.Println(err)
-				defer file.Close()
-				return nil, err, func() {}
-			}
-			defer gzr.Close()
-			return gzr, err, func() {
-				gzr.Close()
-				file.Close()
-			}
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(file)
-			if err != nil {
-				log.Println(err)
-				defer file.Close()
-				return nil, err, func() {}
-			}
-			return xzr, err, func() {
-				xzr = nil
-				file.Close()
-			}
-		} else {
-			return file, err, func() {
-				file.Close()
-			}
+		return gzr, func() { gzr.Close() }, nil
+	case "xz":
+		xzr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, nil, err
 		}
+		return xzr, func() {}, nil
+	case "lzma":
+		lzr, err := lzma.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return lzr, func() {}, nil
+	case "bz2":
+		return bzip2.NewReader(br), func() {}, nil
+	case "zst":
+		zsr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zsr, zsr.Close, nil
+	case "lz4":
+		return lz4.NewReader(br), func() {}, nil
 	}
-
+	return br, func() {}, nil
 }
@@ -15,116 +15,81 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
-	"errors"
 	"fmt"
-	"io"
-	"log"
 	"os"
 	"strings"
-
-	"github.com/ulikunitz/xz"
 )
 
 func parse(name string) (err error) {
-	fmt.Println("Checking", name)
-
-	var zr io.Reader
-
-	if strings.HasPrefix(name, "http") {
-		resp, err := client.Get(name)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer resp.Body.Close()
+	out.Println("Checking", name)
 
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				return err
-			}
-			defer gzr.Close()
-			zr = io.Reader(gzr)
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(resp.Body)
-			if err != nil {
-				return err
-			}
-			//defer xzr.Close()
-			defer func() { xzr = nil }()
-			zr = io.Reader(xzr)
-		} else {
-			zr = resp.Body
+	failed := false
+	p := newPipeline(*jobs)
+	err = loadIndex(name, func(f indexFile) {
+		if _, err := os.Stat(f.Filename); os.IsNotExist(err) {
+			p.Go(nil, func() { out.Record(record{File: f.Filename, Status: "missing", Size: f.Size, Index: name}) })
+			return
 		}
-
-	} else {
-
-		file, err := os.OpenFile(name, os.O_RDONLY, 0666)
-		if err != nil {
-			return err
+		want := map[string]string{"Size": f.Size}
+		for k, v := range f.Sums {
+			want[k] = v
 		}
-		defer file.Close()
-
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(file)
-			if err != nil {
-				return err
-			}
-			defer gzr.Close()
-			zr = io.Reader(gzr)
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(file)
-			if err != nil {
-				return err
+		var rec record
+		p.Go(func(buf *hash_buf) {
+			rec = sumRecord(f.Filename, want, buf)
+		}, func() {
+			rec.Index = name
+			out.Record(rec)
+			if rec.Status != "ok" {
+				failed = true
 			}
-			//defer xzr.Close()
-			defer func() { xzr = nil }()
-			zr = io.Reader(xzr)
-		} else {
-			zr = file
-		}
+		})
+	})
+	p.Wait()
+	if err == nil && failed {
+		err = errFailed
 	}
+	return
+}
 
-	scanner := bufio.NewScanner(zr)
-	var line, filename string
-	sums := make(map[string]string)
-	for {
-		if scanner.Scan() {
-			line = scanner.Text()
+// sumRecord compares the size and checksums of a local file with those
+// wanted by an index, the record is a mismatch if any of them differ.  Only
+// digests as strong as -min-digest are compared, a file with none of them is
+// recorded as weak.
+func sumRecord(filename string, want map[string]string, buf *hash_buf) record {
+	rec := record{File: filename, Size: want["Size"], Expected: want}
+	var algos, weak []string
+	for _, algo := range wantedDigests(want) {
+		if strongDigest(algo) {
+			algos = append(algos, algo)
 		} else {
-			break
+			weak = append(weak, algo)
 		}
-		parts := strings.SplitN(line, ": ", 2)
-		val := ""
-		if len(parts) == 2 {
-			val = strings.TrimSpace(parts[1])
+	}
+	if min_digest != "" && len(algos) == 0 {
+		rec.Status = "weak"
+		rec.Message = fmt.Sprintf("%s: no digest as strong as %s", filename, min_digest)
+		if len(weak) > 0 {
+			rec.Message += ", only " + strings.Join(weak, ", ")
 		}
-		switch parts[0] {
-		case "Filename":
-			filename = val
-		case "Size", "MD5sum", "SHA1", "SHA256", "SHA512":
-			sums[parts[0]] = val
-		case "":
-			if filename != "" {
-				if _, err := os.Stat(filename); os.IsNotExist(err) {
-					fmt.Println("missing", filename)
-					continue
-				}
-				file_sums := getSums(filename)
-				for k, v := range sums {
-					if file_sums[k] != v {
-						fmt.Printf("getsums: %+v\n", file_sums)
-						fmt.Printf("Failed_%s %s (%s != %s)\n", k, filename, file_sums[k], v)
-						err = errors.New("failed verification")
-						continue
-					}
-					delete(sums, k)
-				}
-
-			}
-
+		return rec
+	}
+	file_sums, err := getSums(filename, algos, buf)
+	if err != nil {
+		rec.Status, rec.Message = "unreadable", err.Error()
+		return rec
+	}
+	rec.Status = "ok"
+	rec.Actual = make(map[string]string)
+	for _, k := range append([]string{"Size"}, algos...) {
+		v := want[k]
+		if v == "" {
+			continue
+		}
+		rec.Actual[k] = file_sums[k]
+		if file_sums[k] != v {
+			rec.Status = "mismatch"
 		}
 	}
-	return
+	return rec
 }
@@ -0,0 +1,91 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// A hash_buf is the pair of read buffers a hashing worker alternates between,
+// so one chunk can be hashed while the next is being read.  Each worker owns
+// its own, the buffers are allocated on first use.
+type hash_buf [2][]byte
+
+type task struct {
+	run    func(buf *hash_buf)
+	report func()
+	done   chan struct{}
+}
+
+// A pipeline runs tasks on a pool of workers and calls their report funcs
+// one at a time in the order the tasks were added, so output stays in index
+// order however the work is scheduled.
+type pipeline struct {
+	work     chan *task
+	order    chan *task
+	workers  sync.WaitGroup
+	reported chan struct{}
+}
+
+// newPipeline starts a pipeline with the given number of workers.
+func newPipeline(jobs int) *pipeline {
+	if jobs < 1 {
+		jobs = 1
+	}
+	p := &pipeline{
+		work:     make(chan *task),
+		order:    make(chan *task, jobs*16),
+		reported: make(chan struct{}),
+	}
+	for i := 0; i < jobs; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			buf := new(hash_buf)
+			for t := range p.work {
+				t.run(buf)
+				close(t.done)
+			}
+		}()
+	}
+	go func() {
+		for t := range p.order {
+			<-t.done
+			if t.report != nil {
+				t.report()
+			}
+		}
+		close(p.reported)
+	}()
+	return p
+}
+
+// Go queues run on the next free worker, report is called once run and the
+// reports of all earlier tasks are done.  Either may be nil.
+func (p *pipeline) Go(run func(buf *hash_buf), report func()) {
+	t := &task{run: run, report: report, done: make(chan struct{})}
+	p.order <- t
+	if run == nil {
+		close(t.done)
+		return
+	}
+	p.work <- t
+}
+
+// Wait blocks until every task has run and been reported.
+func (p *pipeline) Wait() {
+	close(p.work)
+	close(p.order)
+	p.workers.Wait()
+	<-p.reported
+}
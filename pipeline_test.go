@@ -0,0 +1,105 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPipelineOrder(t *testing.T) {
+	tests := []struct {
+		jobs, tasks int
+	}{
+		{0, 10},
+		{1, 50},
+		{4, 200},
+		{16, 100},
+	}
+	for _, tt := range tests {
+		p := newPipeline(tt.jobs)
+		var running, max_running, reporting int32
+		var reported []int
+		ran := make([]bool, tt.tasks)
+		for i := 0; i < tt.tasks; i++ {
+			i := i
+			var run func(buf *hash_buf)
+			if i%5 != 3 {
+				run = func(buf *hash_buf) {
+					n := atomic.AddInt32(&running, 1)
+					for m := atomic.LoadInt32(&max_running); n > m && !atomic.CompareAndSwapInt32(&max_running, m, n); {
+						m = atomic.LoadInt32(&max_running)
+					}
+					// Later tasks finish first
+					time.Sleep(time.Duration(tt.tasks-i) * 20 * time.Microsecond)
+					ran[i] = true
+					atomic.AddInt32(&running, -1)
+				}
+			}
+			p.Go(run, func() {
+				if atomic.AddInt32(&reporting, 1) != 1 {
+					t.Errorf("jobs %d: reports overlap", tt.jobs)
+				}
+				if run != nil && !ran[i] {
+					t.Errorf("jobs %d: task %d reported before it ran", tt.jobs, i)
+				}
+				reported = append(reported, i)
+				atomic.AddInt32(&reporting, -1)
+			})
+		}
+		p.Wait()
+
+		if len(reported) != tt.tasks {
+			t.Fatalf("jobs %d: %d of %d tasks reported", tt.jobs, len(reported), tt.tasks)
+		}
+		for i, n := range reported {
+			if n != i {
+				t.Fatalf("jobs %d: report %d was task %d", tt.jobs, i, n)
+			}
+		}
+		jobs := int32(tt.jobs)
+		if jobs < 1 {
+			jobs = 1
+		}
+		if max_running > jobs {
+			t.Errorf("jobs %d: %d tasks ran at once", tt.jobs, max_running)
+		}
+	}
+}
+
+func TestPipelineBuffers(t *testing.T) {
+	// Each worker has its own buffers, so a task never shares one with a
+	// task running at the same time
+	p := newPipeline(4)
+	var lock sync.Mutex
+	in_use := make(map[*hash_buf]bool)
+	for i := 0; i < 100; i++ {
+		p.Go(func(buf *hash_buf) {
+			lock.Lock()
+			if in_use[buf] {
+				t.Error("buffers shared by two running tasks")
+			}
+			in_use[buf] = true
+			lock.Unlock()
+			time.Sleep(100 * time.Microsecond)
+			lock.Lock()
+			delete(in_use, buf)
+			lock.Unlock()
+		}, nil)
+	}
+	p.Wait()
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A signer_policy lists the keys allowed to sign the files it matches and
+// how many of them must have, so a key trusted for one repo cannot vouch for
+// another.  A policy matches a signed file when each of the globs set
+// matches: Path the absolute name of the file, Origin the Origin field of
+// the Release and Suite either its Suite or Codename field.
+type signer_policy struct {
+	Name          string   `toml:"name"`
+	Path          string   `toml:"path"`
+	Origin        string   `toml:"origin"`
+	Suite         string   `toml:"suite"`
+	Signers       []string `toml:"signers"`
+	MinSignatures int      `toml:"min-signatures"`
+}
+
+// The [[policy]] tables of the -config file.
+var policies []signer_policy
+
+// validate checks the globs of a policy and tidies up its fingerprints.
+func (p *signer_policy) validate() error {
+	for _, glob := range []string{p.Path, p.Origin, p.Suite} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("policy %q: bad pattern %q", p.Name, glob)
+		}
+	}
+	if p.MinSignatures < 0 {
+		return fmt.Errorf("policy %q: min-signatures must not be negative", p.Name)
+	}
+	for i, fingerprint := range p.Signers {
+		p.Signers[i] = strings.ToUpper(strings.Replace(fingerprint, " ", "", -1))
+	}
+	return nil
+}
+
+// matches reports whether the policy applies to a signed file, rel is the
+// Release stanza or nil for other files.
+func (p *signer_policy) matches(sf *signedFile, rel *stanza) bool {
+	if p.Path != "" {
+		abs, err := filepath.Abs(sf.signed)
+		if err != nil {
+			return false
+		}
+		if ok, _ := path.Match(p.Path, filepath.ToSlash(abs)); !ok {
+			return false
+		}
+	}
+	if p.Origin != "" {
+		if rel == nil {
+			return false
+		}
+		if ok, _ := path.Match(p.Origin, rel.Get("Origin")); !ok {
+			return false
+		}
+	}
+	if p.Suite != "" {
+		if rel == nil {
+			return false
+		}
+		suite, _ := path.Match(p.Suite, rel.Get("Suite"))
+		codename, _ := path.Match(p.Suite, rel.Get("Codename"))
+		if !suite && !codename {
+			return false
+		}
+	}
+	return true
+}
+
+// check counts the keys in the policy which made a valid signature, a key
+// signing twice only counts once, and fails when there are fewer than
+// MinSignatures (at least one).  Without Signers any valid signature counts.
+func (p *signer_policy) check(sf *signedFile) error {
+	min := p.MinSignatures
+	if min < 1 {
+		min = 1
+	}
+	found := make(map[string]bool)
+	for _, sig := range sf.signatures {
+		if sig.Valid && (len(p.Signers) == 0 || contains(p.Signers, sig.Fingerprint)) {
+			found[sig.Fingerprint] = true
+		}
+	}
+	if len(found) >= min {
+		return nil
+	}
+	name := ""
+	if p.Name != "" {
+		name = fmt.Sprintf(" (policy %s)", p.Name)
+	}
+	if len(p.Signers) == 0 {
+		return fmt.Errorf("%s: %d of the %d valid signatures needed%s", sf.name, len(found), min, name)
+	}
+	return fmt.Errorf("%s: %d of the %d valid signatures needed from %d allowed signers%s", sf.name, len(found), min, len(p.Signers), name)
+}
+
+// checkPolicies checks a signed file against every policy which matches it
+// and the extra policy, if any, such as the one of a mirror in the run
+// command.
+func checkPolicies(sf *signedFile, extra *signer_policy) error {
+	var rel *stanza
+	if !sf.isManifest() {
+		s, err := newStanzaReader(strings.NewReader(sf.content), sf.signed).Next()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		rel = s
+	}
+	for i := range policies {
+		if !policies[i].matches(sf, rel) {
+			continue
+		}
+		if err := policies[i].check(sf); err != nil {
+			return err
+		}
+	}
+	if extra != nil {
+		return extra.check(sf)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	archive_key = "A7236886F3CCCAAD148A27F80E98404D386FA1D9"
+	release_key = "4D64FEC119C2029067D6E791F8D2585B8783D481"
+	other_key   = "6ED0E7B82643E131D05F0E8C9A7CFA52B3C8A7C6"
+)
+
+const test_release = "Origin: Debian\nSuite: stable\nCodename: bookworm\n"
+
+func TestPolicyValidate(t *testing.T) {
+	p := signer_policy{Name: "debian", Signers: []string{"a723 6886 f3cc caad 148a  27f8 0e98 404d 386f a1d9"}}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Signers[0] != archive_key {
+		t.Errorf("fingerprint %q, want %q", p.Signers[0], archive_key)
+	}
+	for _, p := range []signer_policy{
+		{Name: "glob", Path: "/srv/[a-"},
+		{Name: "negative", MinSignatures: -1},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("policy %q validated", p.Name)
+		}
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	sf := &signedFile{name: "/srv/debian/dists/stable/InRelease", signed: "/srv/debian/dists/stable/InRelease"}
+	rel, err := newStanzaReader(strings.NewReader(test_release), sf.signed).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		policy signer_policy
+		rel    *stanza
+		want   bool
+	}{
+		{policy: signer_policy{}, rel: rel, want: true},
+		{policy: signer_policy{Path: "/srv/debian/*/*/InRelease"}, rel: rel, want: true},
+		{policy: signer_policy{Path: "/srv/ubuntu/*"}, rel: rel, want: false},
+		{policy: signer_policy{Origin: "Debian"}, rel: rel, want: true},
+		{policy: signer_policy{Origin: "Ubuntu"}, rel: rel, want: false},
+		{policy: signer_policy{Origin: "Debian"}, rel: nil, want: false},
+		{policy: signer_policy{Suite: "stable"}, rel: rel, want: true},
+		{policy: signer_policy{Suite: "book*"}, rel: rel, want: true},
+		{policy: signer_policy{Suite: "trixie"}, rel: rel, want: false},
+		{policy: signer_policy{Suite: "*"}, rel: nil, want: false},
+		{policy: signer_policy{Origin: "Debian", Suite: "trixie"}, rel: rel, want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.matches(sf, tt.rel); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	sf := &signedFile{name: "InRelease", signatures: []signature_result{
+		{Fingerprint: archive_key, Valid: true},
+		{Fingerprint: archive_key, Valid: true},
+		{Fingerprint: release_key, Valid: true},
+		{Fingerprint: other_key, Valid: false},
+	}}
+	tests := []struct {
+		name   string
+		policy signer_policy
+		ok     bool
+	}{
+		{name: "any signer", policy: signer_policy{}, ok: true},
+		{name: "listed signer", policy: signer_policy{Signers: []string{release_key}}, ok: true},
+		{name: "two of two", policy: signer_policy{Signers: []string{archive_key, release_key}, MinSignatures: 2}, ok: true},
+		{name: "repeated signer counts once", policy: signer_policy{Signers: []string{archive_key}, MinSignatures: 2}, ok: false},
+		{name: "invalid signature", policy: signer_policy{Signers: []string{other_key}}, ok: false},
+		{name: "three of any", policy: signer_policy{MinSignatures: 3}, ok: false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.check(sf)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestCheckPolicies(t *testing.T) {
+	defer func(saved []signer_policy) { policies = saved }(policies)
+	policies = []signer_policy{
+		{Name: "debian", Origin: "Debian", Signers: []string{archive_key}},
+		{Name: "ubuntu", Origin: "Ubuntu", Signers: []string{other_key}},
+	}
+	sf := &signedFile{name: "InRelease", signed: "InRelease", content: test_release,
+		signatures: []signature_result{{Fingerprint: archive_key, Valid: true}}}
+	if err := checkPolicies(sf, nil); err != nil {
+		t.Error(err)
+	}
+	extra := &signer_policy{Name: "mirror", Signers: []string{release_key}}
+	if err := checkPolicies(sf, extra); err == nil || !strings.Contains(err.Error(), "policy mirror") {
+		t.Errorf("extra policy: error %v", err)
+	}
+
+	policies[0].Signers = []string{release_key}
+	if err := checkPolicies(sf, nil); err == nil || !strings.Contains(err.Error(), "policy debian") {
+		t.Errorf("matching policy: error %v", err)
+	}
+
+	// a manifest has no Release fields, so only policies without an Origin
+	// or Suite apply to it
+	sums := &signedFile{name: "SHA256SUMS", signed: "SHA256SUMS",
+		content:    "7692c3ad3540bb803c020b3aee66cd8887123234ea0c6e7143c0add73ff431ed  one\n",
+		signatures: []signature_result{{Fingerprint: other_key, Valid: true}}}
+	if err := checkPolicies(sums, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -15,21 +15,19 @@
 package main
 
 import (
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/sha512"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
-func process(name string) {
+// process queues the hashing of every file under name on p.
+func process(name string, p *pipeline) {
 	fi, err := os.Stat(name)
 	if err != nil {
 		//fmt.Println(err)
@@ -39,45 +37,74 @@ func process(name string) {
 	case mode.IsDir():
 		files, err := ioutil.ReadDir(name)
 		if err != nil {
-			log.Println(err)
+			out.Error(name, err)
 			return
 		}
 		for _, f := range files {
-			process(path.Join(name, f.Name()))
+			process(path.Join(name, f.Name()), p)
 		}
 	case mode.IsRegular():
-		processFile(name)
+		if strings.HasPrefix(path.Base(name), ".") {
+			return
+		}
+		var err error
+		p.Go(func(buf *hash_buf) {
+			_, err = processFile(name, make_digests, buf)
+		}, func() {
+			out.Error(name, err)
+		})
 	}
 }
 
-var buf = make([][]byte, 2)
-
-func processFile(name string) {
-	dir_name, file_name := path.Split(name)
-	if strings.HasPrefix(file_name, ".") {
-		//fmt.Println("has prefix", file_name)
-		return
+// processFile makes sure the .sum file of name holds the size and the listed
+// digests.  Digests already recorded are not computed again, so asking for a
+// new algorithm only extends an existing .sum file, unless the size, mtime,
+// inode or ctime recorded show the file has changed since it was hashed.  A
+// file which cannot be read gives an error and no sums.
+func processFile(name string, algos []string, buf *hash_buf) (sums map[string]string, err error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
 	}
-	sum_name := path.Join(dir_name, fmt.Sprintf(".%s.sum", file_name))
-	//fmt.Println("making", sum_name)
-	//stat, _ := os.Stat(name)
-	if _, err := os.Stat(sum_name); !os.IsNotExist(err) {
-		//fmt.Printf("stat: %+v\n", stat)
-		//fmt.Println("already exists", sum_name)
+	sums = cache.Load(name)
+	if sumCurrent(sums, fi) && len(missingDigests(sums, algos)) == 0 {
 		return
 	}
 
 	file, err := os.OpenFile(name, os.O_RDONLY, 0666)
-	defer file.Close()
 	if err != nil {
-		//log.Println(err)
+		return nil, err
+	}
+	defer file.Close()
+
+	// Hold a lock on the file while hashing so concurrent runs don't clobber
+	// each other, another run may have updated the .sum while we waited.
+	if err = lockFile(file); err != nil {
+		out.Println("warning:", err)
+	}
+	if fi, err = file.Stat(); err != nil {
+		return nil, err
+	}
+	sums = cache.Load(name)
+	if !sumCurrent(sums, fi) {
+		// Rehash every digest the stale .sum recorded
+		algos = append([]string{}, algos...)
+		for _, d := range digests {
+			if _, ok := sums[d.name]; ok {
+				algos = append(algos, d.name)
+			}
+		}
+		sums = make(map[string]string)
+	}
+	needed := missingDigests(sums, algos)
+	if len(needed) == 0 && sums["Size"] != "" {
 		return
 	}
 
-	h_md5 := md5.New()
-	h_sha1 := sha1.New()
-	h_sha256 := sha256.New()
-	h_sha512 := sha512.New()
+	hashes := make([]hash.Hash, len(needed))
+	for j, algo := range needed {
+		hashes[j] = newDigest(algo)
+	}
 	total := uint64(0)
 
 	var wg sync.WaitGroup
@@ -89,46 +116,108 @@ func processFile(name string) {
 		}
 		n, err := file.Read(buf[i])
 		if err != nil {
+			// The hashes may still be reading the other buffer, which the
+			// caller reuses
+			wg.Wait()
 			if err == io.EOF {
 				break
 			}
-			log.Println(err)
-			return
+			return nil, err
 		}
 		wg.Wait()
 
 		to_write := buf[i][:n]
-		wg.Add(4)
-		go func() {
-			defer wg.Done()
-			h_md5.Write(to_write)
-		}()
-		go func() {
-			defer wg.Done()
-			h_sha1.Write(to_write)
-		}()
-		go func() {
-			defer wg.Done()
-			h_sha256.Write(to_write)
-		}()
-		go func() {
-			defer wg.Done()
-			h_sha512.Write(to_write)
-		}()
+		wg.Add(len(hashes))
+		for _, h := range hashes {
+			go func(h hash.Hash) {
+				defer wg.Done()
+				h.Write(to_write)
+			}(h)
+		}
 		total = total + uint64(n)
 		i = 1 - i
 	}
 	wg.Wait()
 
-	out, err := os.Create(sum_name)
-	if err != nil {
-		log.Println(err)
-		return
+	out.Total("hashed", total)
+	sums["Size"] = fmt.Sprintf("%d", total)
+	for j, algo := range needed {
+		sums[algo] = fmt.Sprintf("%x", hashes[j].Sum(nil))
+	}
+	sums["Mtime"] = fi.ModTime().UTC().Format(time.RFC3339Nano)
+	if inode, ctime, ok := fileIdentity(fi); ok {
+		sums["Inode"] = fmt.Sprintf("%d", inode)
+		if cache.KeepsCtime() {
+			sums["Ctime"] = ctime.UTC().Format(time.RFC3339Nano)
+		}
 	}
-	defer out.Close()
-	fmt.Fprintf(out, "Size: %d\n", total)
-	fmt.Fprintf(out, "MD5sum: %x\n", h_md5.Sum(nil))
-	fmt.Fprintf(out, "SHA1: %x\n", h_sha1.Sum(nil))
-	fmt.Fprintf(out, "SHA256: %x\n", h_sha256.Sum(nil))
-	fmt.Fprintf(out, "SHA512: %x\n", h_sha512.Sum(nil))
+
+	if err = cache.Store(name, sums); err != nil {
+		out.Println("warning:", err)
+	}
+	return sums, nil
+}
+
+// missingDigests returns those of algos which are not in sums.
+func missingDigests(sums map[string]string, algos []string) (needed []string) {
+	for _, algo := range algos {
+		if _, ok := sums[algo]; !ok {
+			needed = append(needed, algo)
+		}
+	}
+	return
+}
+
+// sumCurrent reports whether the recorded sums still describe the file, a
+// .sum without the file details is treated as stale.  The ctime is only
+// compared when the cache can record it.
+func sumCurrent(sums map[string]string, fi os.FileInfo) bool {
+	if sums["Size"] != fmt.Sprintf("%d", fi.Size()) ||
+		sums["Mtime"] != fi.ModTime().UTC().Format(time.RFC3339Nano) {
+		return false
+	}
+	if inode, ctime, ok := fileIdentity(fi); ok {
+		return sums["Inode"] == fmt.Sprintf("%d", inode) &&
+			(!cache.KeepsCtime() || sums["Ctime"] == ctime.UTC().Format(time.RFC3339Nano))
+	}
+	return true
+}
+
+// gcSums removes the cached records of files under name which no longer
+// exist.
+func gcSums(name string) {
+	err := cache.Walk(name, func(file_name string) {
+		if _, err := os.Lstat(file_name); os.IsNotExist(err) {
+			if err := cache.Remove(file_name); err != nil {
+				out.Error(file_name, err)
+				return
+			}
+			out.Record(record{File: file_name, Status: "removed"})
+		}
+	})
+	out.Error(name, err)
+}
+
+// migrateSums moves the cached records of the files under name from one
+// cache to another.
+func migrateSums(name string, from, to sum_cache) (count int) {
+	err := from.Walk(name, func(file_name string) {
+		if _, err := os.Lstat(file_name); os.IsNotExist(err) {
+			return
+		}
+		sums := from.Load(file_name)
+		if !to.KeepsCtime() {
+			delete(sums, "Ctime")
+		}
+		if err := to.Store(file_name, sums); err != nil {
+			out.Error(file_name, err)
+			return
+		}
+		if err := from.Remove(file_name); err != nil {
+			out.Error(file_name, err)
+		}
+		count++
+	})
+	out.Error(name, err)
+	return
 }
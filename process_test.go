@@ -0,0 +1,108 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A no_ctime_cache is a dotfile cache which, like the xattr one, cannot
+// record the ctime.
+type no_ctime_cache struct{ dotfile_cache }
+
+func (no_ctime_cache) KeepsCtime() bool { return false }
+
+func TestProcessFileInvalidation(t *testing.T) {
+	const (
+		sha256_one = "7692c3ad3540bb803c020b3aee66cd8887123234ea0c6e7143c0add73ff431ed"
+		stale      = "0000000000000000000000000000000000000000000000000000000000000000"
+	)
+	tests := []struct {
+		name   string
+		cache  sum_cache
+		field  string // the recorded field made stale, "" for none
+		value  string // its stale value, "" to remove it
+		rehash bool
+	}{
+		{name: "current", cache: dotfile_cache{}},
+		{name: "size", cache: dotfile_cache{}, field: "Size", value: "4", rehash: true},
+		{name: "mtime", cache: dotfile_cache{}, field: "Mtime", value: "2001-01-01T00:00:00Z", rehash: true},
+		{name: "inode", cache: dotfile_cache{}, field: "Inode", value: "1", rehash: true},
+		{name: "ctime", cache: dotfile_cache{}, field: "Ctime", value: "2001-01-01T00:00:00Z", rehash: true},
+		{name: "no mtime", cache: dotfile_cache{}, field: "Mtime", rehash: true},
+		{name: "no ctime kept", cache: no_ctime_cache{}},
+		{name: "ctime not kept", cache: no_ctime_cache{}, field: "Ctime", value: "2001-01-01T00:00:00Z"},
+		{name: "size not kept ctime", cache: no_ctime_cache{}, field: "Size", value: "4", rehash: true},
+	}
+	defer func(c sum_cache) { cache = c }(cache)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache = tt.cache
+			name := filepath.Join(t.TempDir(), "one.deb")
+			if err := os.WriteFile(name, []byte("one"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			sums, err := processFile(name, []string{"SHA256"}, new(hash_buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sums["SHA256"] != sha256_one || sums["Size"] != "3" {
+				t.Fatalf("first hash: %v", sums)
+			}
+			if _, ok := sums["Ctime"]; ok != tt.cache.KeepsCtime() {
+				t.Errorf("Ctime recorded %v, cache keeps it %v", ok, tt.cache.KeepsCtime())
+			}
+
+			// Record a digest the file does not have, to see if it is trusted
+			sums["SHA256"] = stale
+			if tt.field != "" && tt.value == "" {
+				delete(sums, tt.field)
+			} else if tt.field != "" {
+				sums[tt.field] = tt.value
+			}
+			if err = cache.Store(name, sums); err != nil {
+				t.Fatal(err)
+			}
+			sums, err = processFile(name, []string{"SHA256"}, new(hash_buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := stale
+			if tt.rehash {
+				want = sha256_one
+			}
+			if sums["SHA256"] != want {
+				t.Errorf("SHA256 %s, want %s", sums["SHA256"], want)
+			}
+		})
+	}
+}
+
+func TestProcessFileUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	// Reading a directory fails after it has been opened
+	if sums, err := processFile(dir, []string{"SHA256"}, new(hash_buf)); err == nil || sums != nil {
+		t.Errorf("directory: sums %v, error %v", sums, err)
+	}
+	if sums, err := processFile(filepath.Join(dir, "gone.deb"), []string{"SHA256"}, new(hash_buf)); err == nil || sums != nil {
+		t.Errorf("missing file: sums %v, error %v", sums, err)
+	}
+	rec := sumRecord(dir, map[string]string{"Size": "3", "SHA256": "00"}, new(hash_buf))
+	if rec.Status != "unreadable" || rec.Message == "" {
+		t.Errorf("directory: status %q, message %q, want unreadable with the error", rec.Status, rec.Message)
+	}
+}
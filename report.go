@@ -0,0 +1,301 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A record is the result for one file, written as a line of text or as a
+// JSON object depending on the -format option.  Status is one of ok,
+// missing, mismatch, weak, unreadable, unknown, bad-signature, stale, removed,
+// listed, added or modified.  The expected and actual maps use the same names as the .sum
+// files, and Message holds the error which stopped a file being processed.
+// A signed file has a record of its own listing each of its signatures.
+type record struct {
+	File     string            `json:"file"`
+	Status   string            `json:"status"`
+	Size     string            `json:"size,omitempty"`
+	Expected map[string]string `json:"expected,omitempty"`
+	Actual   map[string]string `json:"actual,omitempty"`
+	Index    string            `json:"index,omitempty"`
+	Signer   string            `json:"signer,omitempty"`
+	Message  string            `json:"message,omitempty"`
+
+	Signatures []signature_result `json:"signatures,omitempty"`
+}
+
+// The summary closing a run, the number of records of each status, any
+// totals the command keeps (such as the bytes hashed) and the exit code.
+type summary struct {
+	Command string            `json:"command"`
+	Counts  map[string]int    `json:"counts"`
+	Totals  map[string]uint64 `json:"totals,omitempty"`
+	Exit    int               `json:"exit"`
+}
+
+// The exit code is a bitmask of the kinds of problem found, limited to those
+// chosen with the -fail-on option.  exit_usage is set whatever the option when
+// a command is used wrongly or cannot be set up, such as with a keyring which
+// does not load.
+const (
+	exit_mismatch   = 1
+	exit_missing    = 2
+	exit_signature  = 4
+	exit_unreadable = 8
+	exit_usage      = 64
+)
+
+// The -fail-on names of the exit code bits and the record statuses setting
+// each of them, a file without a digest strong enough counts as a mismatch
+// and a remote file with an unknown modification time as unreadable.
+var fail_classes = []struct {
+	name   string
+	bit    int
+	status string
+}{
+	{"mismatch", exit_mismatch, "mismatch"},
+	{"mismatch", exit_mismatch, "weak"},
+	{"missing", exit_missing, "missing"},
+	{"signature", exit_signature, "bad-signature"},
+	{"unreadable", exit_unreadable, "unreadable"},
+	{"unreadable", exit_unreadable, "unknown"},
+}
+
+// parseFailOn turns a comma separated list of problem kinds, such as the
+// -fail-on option, into a mask of exit code bits.
+func parseFailOn(list string) (mask int, err error) {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, c := range fail_classes {
+			if c.name == name || name == "all" {
+				mask |= c.bit
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown -fail-on kind %q, expected mismatch, missing, signature, unreadable or all", name)
+		}
+	}
+	return
+}
+
+// errFailed is returned by commands which found problems already reported
+// file by file.
+var errFailed = errors.New("failed verification")
+
+// A reporter writes the records of a command.  In the text format records
+// are written as the traditional free form lines, in the json format they
+// are collected into one document written by Close, and in the ndjson format
+// each is written as it comes followed by the summary.  Progress lines and
+// warnings go to stderr in the structured formats so stdout can be parsed.
+type reporter struct {
+	lock    sync.Mutex
+	format  string
+	w       io.Writer
+	records []record
+	summary summary
+	closed  bool
+	quiet   bool
+	mask    int // the -fail-on bits in force
+	code    int
+}
+
+// The reporter used for all output, set up from the -format option.
+var out = newReporter("text", "")
+
+func newReporter(format, command string) *reporter {
+	return &reporter{
+		format:  format,
+		w:       os.Stdout,
+		records: []record{},
+		summary: summary{Command: command, Counts: make(map[string]int)},
+	}
+}
+
+// openReporter checks the -format option and returns a reporter for it,
+// when quiet the progress lines are dropped.
+func openReporter(format, command string, quiet bool) (*reporter, error) {
+	switch format {
+	case "text", "json", "ndjson":
+		r := newReporter(format, command)
+		r.quiet = quiet
+		return r, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected text, json or ndjson", format)
+}
+
+// Record writes the result for a file, hiding any password in its URL.
+func (r *reporter) Record(rec record) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rec.File, rec.Index = redactURL(rec.File), redactURL(rec.Index)
+	r.summary.Counts[rec.Status]++
+	for _, c := range fail_classes {
+		if c.status == rec.Status {
+			r.code |= c.bit & r.mask
+		}
+	}
+	switch r.format {
+	case "json":
+		r.records = append(r.records, rec)
+	case "ndjson":
+		json.NewEncoder(r.w).Encode(rec)
+	default:
+		r.text(rec)
+	}
+}
+
+// text writes a record the way the commands always have.
+func (r *reporter) text(rec record) {
+	switch rec.Status {
+	case "ok":
+	case "mismatch":
+		for _, k := range append([]string{"Size"}, wantedDigests(rec.Expected)...) {
+			if v, ok := rec.Actual[k]; ok && rec.Expected[k] != v {
+				fmt.Fprintf(r.w, "Failed_%s %s (%s != %s)\n", k, rec.File, v, rec.Expected[k])
+			}
+		}
+	case "listed", "added", "modified":
+		fmt.Fprintln(r.w, rec.Size, rec.File)
+	default:
+		if rec.Message != "" {
+			fmt.Fprintln(r.w, "error:", rec.Message)
+		} else {
+			fmt.Fprintln(r.w, rec.Status, rec.File)
+		}
+	}
+}
+
+// Error records an error which stopped the processing of name, as a
+// bad-signature if it is a signature_error and as unreadable otherwise.
+// errFailed is not recorded as the failures have been already.
+func (r *reporter) Error(name string, err error) {
+	if err == nil || err == errFailed {
+		return
+	}
+	status := "unreadable"
+	var sig_err *signature_error
+	if errors.As(err, &sig_err) {
+		status = "bad-signature"
+	}
+	r.Record(record{File: name, Status: status, Message: err.Error()})
+}
+
+// Setup records an error which stopped a command, or a mirror of the run
+// command, being set up, such as a keyring or root directory which cannot be
+// used.  It sets exit_usage whatever the -fail-on option.
+func (r *reporter) Setup(name string, err error) {
+	r.Error(name, err)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.code |= exit_usage
+}
+
+// Policy sets the exit code bits which the records from now on may set,
+// returning the previous ones.
+func (r *reporter) Policy(mask int) (old int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	old, r.mask = r.mask, mask
+	return
+}
+
+// ExitCode returns the exit code bits set by the records so far.
+func (r *reporter) ExitCode() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.code
+}
+
+// PrintSummary writes the closing line of check, verify and audit in the
+// text format, the structured formats always end with the summary.
+func (r *reporter) PrintSummary() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.format != "text" {
+		return
+	}
+	c := r.summary.Counts
+	fmt.Fprintf(r.w, "Summary: %d ok, %d missing, %d failed, %d unreadable, %d bad signatures, %d bytes hashed\n",
+		c["ok"], c["missing"], c["mismatch"]+c["weak"], c["unreadable"], c["bad-signature"], r.summary.Totals["hashed"])
+}
+
+// Total adds n to a named total of the summary.
+func (r *reporter) Total(name string, n uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.summary.Totals == nil {
+		r.summary.Totals = make(map[string]uint64)
+	}
+	r.summary.Totals[name] += n
+}
+
+// Println writes a progress line, to stdout in the text format and to
+// stderr otherwise, or nowhere with -quiet.  Passwords in URLs are hidden.
+func (r *reporter) Println(a ...interface{}) {
+	fmt.Fprintln(r.info(), redactArgs(a)...)
+}
+
+// Printf is Println with a format.
+func (r *reporter) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(r.info(), format, redactArgs(a)...)
+}
+
+func (r *reporter) info() io.Writer {
+	if r.quiet {
+		return ioutil.Discard
+	}
+	if r.format == "text" {
+		return r.w
+	}
+	return os.Stderr
+}
+
+// Close writes the summary with the exit code, and in the json format every
+// record before it.
+func (r *reporter) Close(code int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.summary.Exit = code
+	switch r.format {
+	case "json":
+		enc := json.NewEncoder(r.w)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Records []record `json:"records"`
+			Summary summary  `json:"summary"`
+		}{r.records, r.summary})
+	case "ndjson":
+		json.NewEncoder(r.w).Encode(struct {
+			Summary summary `json:"summary"`
+		}{r.summary})
+	}
+}
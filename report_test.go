@@ -0,0 +1,105 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestParseFailOn(t *testing.T) {
+	tests := []struct {
+		list string
+		mask int
+		err  bool
+	}{
+		{list: "", mask: 0},
+		{list: "mismatch,signature,unreadable", mask: exit_mismatch | exit_signature | exit_unreadable},
+		{list: "all", mask: exit_mismatch | exit_missing | exit_signature | exit_unreadable},
+		{list: "missing", mask: exit_missing},
+		{list: " mismatch , missing ,", mask: exit_mismatch | exit_missing},
+		{list: "weak", err: true},
+		{list: "all,bogus", err: true},
+	}
+	for _, tt := range tests {
+		mask, err := parseFailOn(tt.list)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.list, err)
+		} else if mask != tt.mask {
+			t.Errorf("%q: mask %d, want %d", tt.list, mask, tt.mask)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		fail_on  string
+		statuses []string
+		errs     []error
+		setup    bool
+		want     int
+	}{
+		{fail_on: "all", statuses: []string{"ok", "stale", "removed", "listed"}, want: 0},
+		{fail_on: "all", statuses: []string{"mismatch"}, want: exit_mismatch},
+		{fail_on: "all", statuses: []string{"weak"}, want: exit_mismatch},
+		{fail_on: "all", statuses: []string{"missing", "unknown"}, want: exit_missing | exit_unreadable},
+		{fail_on: "mismatch,signature,unreadable", statuses: []string{"missing", "ok"}, want: 0},
+		{fail_on: "missing", statuses: []string{"mismatch", "missing", "unreadable"}, want: exit_missing},
+		{fail_on: "all", errs: []error{errors.New("read failed")}, want: exit_unreadable},
+		{fail_on: "all", errs: []error{signatureFailure(errors.New("bad"))}, want: exit_signature},
+		{fail_on: "all", errs: []error{errFailed, nil}, want: 0},
+		{fail_on: "mismatch", errs: []error{signatureFailure(errors.New("bad"))}, want: 0},
+		{fail_on: "mismatch", statuses: []string{"mismatch"}, setup: true, want: exit_mismatch | exit_usage},
+		{fail_on: "", setup: true, want: exit_usage},
+	}
+	for _, tt := range tests {
+		r, err := openReporter("ndjson", "test", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.w = io.Discard
+		mask, _ := parseFailOn(tt.fail_on)
+		r.Policy(mask)
+		for _, status := range tt.statuses {
+			r.Record(record{File: "f", Status: status})
+		}
+		for _, err := range tt.errs {
+			r.Error("f", err)
+		}
+		if tt.setup {
+			r.Setup("keyring", errors.New("no such file"))
+		}
+		if got := r.ExitCode(); got != tt.want {
+			t.Errorf("-fail-on %q, %v %v: exit %d, want %d", tt.fail_on, tt.statuses, tt.errs, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyPerMirror(t *testing.T) {
+	// A mirror's own fail-on applies to its records only
+	r, _ := openReporter("ndjson", "run", true)
+	r.w = io.Discard
+	all, _ := parseFailOn("all")
+	mismatch, _ := parseFailOn("mismatch")
+	r.Policy(mismatch)
+	old := r.Policy(all)
+	r.Record(record{File: "a", Status: "missing"})
+	r.Policy(old)
+	r.Record(record{File: "b", Status: "unreadable"})
+	if got := r.ExitCode(); got != exit_missing {
+		t.Errorf("exit %d, want %d", got, exit_missing)
+	}
+}
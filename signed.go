@@ -0,0 +1,516 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// The extensions a detached signature may have next to the file it signs.
+var detached_exts = []string{".gpg", ".asc", ".sig"}
+
+// A signedFile is the signed text of an InRelease, or of the file covered by a
+// detached signature, along with who signed it.
+type signedFile struct {
+	name       string // the file holding the signature
+	signed     string // the file the signature covers
+	content    string
+	detached   bool
+	issuer     uint64
+	signer     string // fingerprint of the key which made the signature
+	signatures []signature_result
+	signed_at  time.Time
+	hashes     []crypto.Hash // the hashes listed in the Hash armor headers
+}
+
+// A signature_error is a failure to authenticate a signed file, as opposed
+// to a failure to read it.
+type signature_error struct {
+	err error
+}
+
+func (e *signature_error) Error() string { return e.err.Error() }
+
+// signatureFailure marks err as a failed authentication, unless it comes
+// from reading a local file or URL.
+func signatureFailure(err error) error {
+	var path_err *os.PathError
+	var url_err *url.Error
+	if err == nil || errors.As(err, &path_err) || errors.As(err, &url_err) {
+		return err
+	}
+	return &signature_error{err}
+}
+
+// signerID returns the fingerprint of the key which made the signature, or
+// the key ID of the issuer when it has not been checked.
+func (sf *signedFile) signerID() string {
+	if sf.signer != "" {
+		return sf.signer
+	}
+	return fmt.Sprintf("0x%02X", sf.issuer)
+}
+
+// readSigned reads a PGP signed file and checks its signature against
+// keyring.  name may be a cleartext signed file (InRelease), a detached
+// signature (Release.gpg, SHA256SUMS.asc, ...) next to the file it signs, or
+// a plain file (Release) which has a detached signature next to it.  When
+// keyring is nil the signer is only printed.
+func readSigned(name string, keyring openpgp.KeyRing) (*signedFile, error) {
+	for _, ext := range detached_exts {
+		if strings.HasSuffix(name, ext) {
+			return readDetached(name, strings.TrimSuffix(name, ext), keyring)
+		}
+	}
+	for _, ext := range detached_exts {
+		if _, err := os.Stat(name + ext); err == nil {
+			return readDetached(name+ext, name, keyring)
+		}
+	}
+	return readCleartext(name, keyring)
+}
+
+// The hash names a cleartext signed file may list in its Hash armor headers.
+var armor_hash_names = map[string]crypto.Hash{
+	"MD5":       crypto.MD5,
+	"SHA1":      crypto.SHA1,
+	"RIPEMD160": crypto.RIPEMD160,
+	"SHA224":    crypto.SHA224,
+	"SHA256":    crypto.SHA256,
+	"SHA384":    crypto.SHA384,
+	"SHA512":    crypto.SHA512,
+	"SHA3-256":  crypto.SHA3_256,
+	"SHA3-512":  crypto.SHA3_512,
+}
+
+// readCleartext reads a cleartext signed file, such as InRelease, following
+// the cleartext signature framework of RFC 4880: the Hash armor headers list
+// the hashes the signatures may use, dash-escaped lines are unescaped and
+// trailing whitespace is not signed.  Anything but blank lines outside of the
+// one signed message is rejected, so the content parsed is exactly the text
+// which was signed.
+func readCleartext(name string, keyring openpgp.KeyRing) (*signedFile, error) {
+	zr, err, file_close := open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file_close()
+
+	sf := &signedFile{name: name, signed: name}
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	var lines []string
+	var signature strings.Builder
+	SECTION := 0
+	HEAD := 1
+	CONTENT := 2
+	SIGNATURE := 3
+	END := 4
+	for line_no := 1; scanner.Scan(); line_no++ {
+		line := scanner.Text()
+		switch SECTION {
+		case 0:
+			if line == "-----BEGIN PGP SIGNED MESSAGE-----" {
+				SECTION = HEAD
+			} else if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("%s:%d: unsigned text before the signed message", name, line_no)
+			}
+		case HEAD:
+			if line == "" {
+				SECTION = CONTENT
+				continue
+			}
+			key, value, ok := strings.Cut(line, ": ")
+			if !ok || key != "Hash" {
+				return nil, fmt.Errorf("%s:%d: unexpected armor header %q", name, line_no, line)
+			}
+			for _, hash_name := range strings.Split(value, ",") {
+				h, ok := armor_hash_names[strings.TrimSpace(hash_name)]
+				if !ok {
+					return nil, fmt.Errorf("%s:%d: unknown hash %q", name, line_no, strings.TrimSpace(hash_name))
+				}
+				sf.hashes = append(sf.hashes, h)
+			}
+		case CONTENT:
+			switch {
+			case line == "-----BEGIN PGP SIGNATURE-----":
+				SECTION = SIGNATURE
+				signature.WriteString(line + "\n")
+				continue
+			case strings.HasPrefix(line, "- "):
+				line = line[2:]
+			case strings.HasPrefix(line, "-"):
+				// Signed lines starting with a dash are always escaped, so
+				// this is armor, such as a second signed message.
+				return nil, fmt.Errorf("%s:%d: line is not dash-escaped: %q", name, line_no, line)
+			}
+			lines = append(lines, strings.TrimRight(line, " \t"))
+		case SIGNATURE:
+			signature.WriteString(line + "\n")
+			if line == "-----END PGP SIGNATURE-----" {
+				SECTION = END
+			}
+		case END:
+			if line == "-----BEGIN PGP SIGNED MESSAGE-----" {
+				return nil, fmt.Errorf("%s:%d: more than one signed message", name, line_no)
+			} else if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("%s:%d: unsigned text after the signature", name, line_no)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	switch SECTION {
+	case SIGNATURE:
+		return nil, errors.New("Unterminated signature block in file")
+	case END:
+	default:
+		return nil, errors.New("Missing signature block in file")
+	}
+
+	signature_block, err := armor.Decode(strings.NewReader(signature.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) > 0 {
+		sf.content = strings.Join(lines, "\n") + "\n"
+	}
+	err = checkSignature(sf, signature_block.Body, keyring, func(h hash.Hash, text bool) {
+		// The cleartext framework always signs the canonical text form,
+		// without the line break before the signature
+		for i, line := range lines {
+			if i > 0 {
+				h.Write([]byte{'\r', '\n'})
+			}
+			h.Write([]byte(line))
+		}
+	})
+	return sf, err
+}
+
+// allowsHash reports whether a signature made with h is allowed by the Hash
+// armor headers of a cleartext signed file, when it has any.
+func (sf *signedFile) allowsHash(h crypto.Hash) bool {
+	if len(sf.hashes) == 0 {
+		return true
+	}
+	for _, allowed := range sf.hashes {
+		if allowed == h {
+			return true
+		}
+	}
+	return false
+}
+
+// readDetached reads the signature in sig_name, either armored or binary, and
+// checks it over the content of signed_name.
+func readDetached(sig_name, signed_name string, keyring openpgp.KeyRing) (*signedFile, error) {
+	sig_data, err := readAll(sig_name)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader = bytes.NewReader(sig_data)
+	if bytes.HasPrefix(bytes.TrimSpace(sig_data), []byte("-----BEGIN PGP")) {
+		signature_block, err := armor.Decode(bytes.NewReader(sig_data))
+		if err != nil {
+			return nil, err
+		}
+		body = signature_block.Body
+	}
+
+	content, err := readAll(signed_name)
+	if err != nil {
+		return nil, err
+	}
+
+	sf := &signedFile{name: sig_name, signed: signed_name, content: string(content), detached: true}
+	err = checkSignature(sf, body, keyring, func(h hash.Hash, text bool) {
+		if text {
+			h.Write(bytes.Replace(bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1),
+				[]byte("\n"), []byte("\r\n"), -1))
+		} else {
+			h.Write(content)
+		}
+	})
+	return sf, err
+}
+
+// readAll returns the raw, undecompressed, content of name.
+func readAll(name string) ([]byte, error) {
+	rc, err := openRaw(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// A signature_result is the outcome of checking one of the signatures of a
+// signed file, Fingerprint and Name are those of the key which made it.
+type signature_result struct {
+	Issuer      string    `json:"issuer"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Created     time.Time `json:"created"`
+	Valid       bool      `json:"valid"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// checkSignature reads every signature packet from r, a Debian InRelease is
+// often signed by both an archive and a release key, and checks each of
+// them against keyring.  write is called to feed the signed content into the
+// hash of each signature.  The file is authenticated when at least one of
+// the signatures is good and was made by a key valid at the time.
+func checkSignature(sf *signedFile, r io.Reader, keyring openpgp.KeyRing, write func(h hash.Hash, text bool)) error {
+	var reasons []string
+	for {
+		p, err := packet.Read(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Println("Error in signature:", err)
+			return err
+		}
+
+		sig, ok := p.(*packet.Signature)
+		if !ok {
+			continue
+		}
+		issuer, created := signatureIssuer(sig), sig.CreationTime
+		text := sig.SigType == packet.SigTypeText
+
+		res := signature_result{Issuer: fmt.Sprintf("0x%02X", issuer), Created: created}
+		if len(sf.signatures) == 0 {
+			sf.issuer, sf.signed_at = issuer, created
+		}
+		if keyring == nil {
+			out.Printf("  %s - Signed by 0x%02X at %v\n", sf.name, issuer, created)
+			sf.signatures = append(sf.signatures, res)
+			continue
+		}
+		out.Printf("Verifying %s has been signed by 0x%02X at %v...\n", sf.name, issuer, created)
+
+		switch {
+		case issuer == 0:
+			res.Reason = "signature doesn't have an issuer"
+		case !sig.Hash.Available():
+			res.Reason = "signature hash is not supported"
+		case !sf.allowsHash(sig.Hash):
+			res.Reason = fmt.Sprintf("signature hash %v is not listed in the Hash armor header", sig.Hash)
+		case !strongSignatureHash(sig.Hash):
+			res.Reason = fmt.Sprintf("signature hash %v is weaker than %s", sig.Hash, min_digest)
+		default:
+			// Key IDs may collide, the key which made the signature is the
+			// one it verifies with, and has the fingerprint it names.
+			keys := keyring.KeysById(issuer)
+			res.Reason = "no matching public key found"
+			for _, key := range keys {
+				if sig.IssuerFingerprint != nil && !bytes.Equal(sig.IssuerFingerprint, key.PublicKey.Fingerprint) {
+					continue
+				}
+				h, err := sig.PrepareVerify()
+				if err != nil {
+					res.Reason = err.Error()
+					break
+				}
+				write(h, text)
+				if key.PublicKey.VerifySignature(h, sig) != nil {
+					res.Reason = "bad signature"
+					continue
+				}
+				res.Fingerprint, res.Name = keyFingerprint(key.Entity), keyName(key.Entity)
+				res.Reason = ""
+				if err := keyValidAt(key, created); err != nil {
+					res.Reason = err.Error()
+				} else if err := keyStrongEnough(key.PublicKey); err != nil {
+					res.Reason = err.Error()
+				} else if sig.SigExpired(time.Now()) {
+					res.Reason = "signature expired"
+				}
+				break
+			}
+		}
+		res.Valid = res.Reason == ""
+		if res.Valid {
+			out.Printf("  Good signature from %s %s\n", res.Fingerprint, res.Name)
+			if sf.signer == "" {
+				sf.issuer, sf.signer, sf.signed_at = issuer, res.Fingerprint, created
+			}
+		} else {
+			out.Printf("  Bad signature from %s: %s\n", res.Issuer, res.Reason)
+			reasons = append(reasons, res.Issuer+" "+res.Reason)
+		}
+		sf.signatures = append(sf.signatures, res)
+	}
+
+	if len(sf.signatures) == 0 {
+		return errors.New("Unable to read signature block")
+	}
+	if keyring == nil || sf.signer != "" {
+		return nil
+	}
+	out.Println("Failed verification")
+	return errors.New("Failed verification, " + strings.Join(reasons, ", "))
+}
+
+// keyValidAt checks that key could make a signature at time t: it and its
+// primary key existed, had not expired and were not revoked, and the key is
+// allowed to sign.  A key retired or superseded after t still counts for
+// signatures made before, other revocations apply to all signatures.
+func keyValidAt(key openpgp.Key, t time.Time) error {
+	e := key.Entity
+	for _, rev := range e.Revocations {
+		if !revocationAllows(rev, t) {
+			return fmt.Errorf("key %s has been revoked", keyFingerprint(e))
+		}
+	}
+	primary_sig, _ := e.PrimarySelfSignature()
+	if expiry, ok := keyExpiry(e.PrimaryKey, primary_sig); ok && t.After(expiry) {
+		return fmt.Errorf("key %s expired at %v", keyFingerprint(e), expiry)
+	}
+	if key.PublicKey != e.PrimaryKey {
+		for _, rev := range key.Revocations {
+			if !revocationAllows(rev, t) {
+				return fmt.Errorf("subkey %X has been revoked", key.PublicKey.Fingerprint)
+			}
+		}
+		if expiry, ok := keyExpiry(key.PublicKey, key.SelfSignature); ok && t.After(expiry) {
+			return fmt.Errorf("subkey %X expired at %v", key.PublicKey.Fingerprint, expiry)
+		}
+	}
+	if t.Before(key.PublicKey.CreationTime) {
+		return fmt.Errorf("signature predates key %X", key.PublicKey.Fingerprint)
+	}
+	if sig := key.SelfSignature; sig != nil && sig.FlagsValid && !sig.FlagSign {
+		return fmt.Errorf("key %X is not a signing key", key.PublicKey.Fingerprint)
+	}
+	return nil
+}
+
+// keyStrongEnough checks an RSA key is at least -min-rsa-bits long.
+func keyStrongEnough(pub *packet.PublicKey) error {
+	switch pub.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly:
+		bits, err := pub.BitLength()
+		if err != nil {
+			return err
+		}
+		if int(bits) < min_rsa_bits {
+			return fmt.Errorf("RSA key %X has %d bits, less than %d", pub.Fingerprint, bits, min_rsa_bits)
+		}
+	}
+	return nil
+}
+
+// revocationAllows reports whether a signature made at t survives a
+// revocation, which is only the case for keys superseded (1) or retired (3)
+// after t.
+func revocationAllows(rev *packet.Signature, t time.Time) bool {
+	if rev.RevocationReason == nil {
+		return false
+	}
+	reason := *rev.RevocationReason
+	return (reason == packet.KeySuperseded || reason == packet.KeyRetired) && t.Before(rev.CreationTime)
+}
+
+// signatureIssuer returns the key ID of the key which made sig, taken from
+// the issuer fingerprint when there is no issuer key ID subpacket.  A v4 key
+// ID is the end of the fingerprint, a v5 or v6 one the start.
+func signatureIssuer(sig *packet.Signature) uint64 {
+	switch {
+	case sig.IssuerKeyId != nil:
+		return *sig.IssuerKeyId
+	case len(sig.IssuerFingerprint) < 8:
+		return 0
+	case sig.Version == 4:
+		return binary.BigEndian.Uint64(sig.IssuerFingerprint[len(sig.IssuerFingerprint)-8:])
+	}
+	return binary.BigEndian.Uint64(sig.IssuerFingerprint[:8])
+}
+
+// keyExpiry returns when pub expires according to its self or binding
+// signature, the lifetime counts from the creation of the key.
+func keyExpiry(pub *packet.PublicKey, sig *packet.Signature) (time.Time, bool) {
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}, false
+	}
+	return pub.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second), true
+}
+
+// crossCheck compares the content of an InRelease with the Release in the
+// same directory, or the other way around, when both are present.  A
+// detached Release.gpg is verified as part of the comparison.
+func crossCheck(sf *signedFile, keyring openpgp.KeyRing) error {
+	dir, base := path.Split(sf.signed)
+	var other string
+	var err error
+	switch base {
+	case "InRelease":
+		release := path.Join(dir, "Release")
+		if _, err := os.Stat(release); err != nil {
+			return nil
+		}
+		out.Println("Cross-checking", sf.signed, "against", release)
+		if _, serr := os.Stat(release + ".gpg"); serr == nil {
+			var osf *signedFile
+			if osf, err = readDetached(release+".gpg", release, keyring); err == nil {
+				other = osf.content
+			}
+		} else {
+			var data []byte
+			data, err = readAll(release)
+			other = string(data)
+		}
+	case "Release":
+		inrelease := path.Join(dir, "InRelease")
+		if _, err := os.Stat(inrelease); err != nil {
+			return nil
+		}
+		out.Println("Cross-checking", sf.signed, "against", inrelease)
+		var osf *signedFile
+		if osf, err = readCleartext(inrelease, keyring); err == nil {
+			other = osf.content
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if other != sf.content {
+		return errors.New("InRelease and Release contents differ in " + dir)
+	}
+	return nil
+}
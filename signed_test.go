@@ -0,0 +1,248 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// clearsignText signs text with a new key, returning the cleartext signed
+// message and a keyring holding the key.  As with gpg --clearsign, the final
+// line break of text is the one before the signature and is not signed.
+func clearsignText(t *testing.T, text string) (string, openpgp.EntityList) {
+	t.Helper()
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA, DefaultHash: crypto.SHA256}
+	e, err := openpgp.NewEntity("Test Archive", "", "test@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, e.PrivateKey, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, strings.TrimSuffix(text, "\n"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(buf.String(), "\n") + "\n", openpgp.EntityList{e}
+}
+
+func TestReadCleartext(t *testing.T) {
+	release := "Origin: Test\nSuite: stable\n"
+	tests := []struct {
+		name    string
+		text    string
+		edit    func(msg string) string
+		content string
+		hashes  []crypto.Hash
+		err     string
+	}{
+		{name: "plain", text: release, content: release, hashes: []crypto.Hash{crypto.SHA256}},
+		{name: "dash-escaped", text: "-----BEGIN PGP SIGNATURE-----\n- x\nSuite: stable\n",
+			content: "-----BEGIN PGP SIGNATURE-----\n- x\nSuite: stable\n"},
+		{name: "trailing whitespace", text: "Origin: Test \t\nSuite: stable  \n", content: release},
+		{name: "trailing whitespace added", text: release, content: release,
+			edit: func(msg string) string { return strings.Replace(msg, "Origin: Test\n", "Origin: Test   \n", 1) }},
+		{name: "blank lines around", text: release, content: release,
+			edit: func(msg string) string { return "\n  \n" + msg + "\n\n" }},
+		{name: "text before", text: release, err: "unsigned text before",
+			edit: func(msg string) string { return "Origin: Evil\n" + msg }},
+		{name: "text after", text: release, err: "unsigned text after",
+			edit: func(msg string) string { return msg + "Origin: Evil\n" }},
+		{name: "second message", text: release, err: "more than one signed message",
+			edit: func(msg string) string { return msg + msg }},
+		{name: "unescaped dash", text: release, err: "not dash-escaped",
+			edit: func(msg string) string { return strings.Replace(msg, "Suite:", "-Suite:", 1) }},
+		{name: "changed content", text: release, err: "bad signature",
+			edit: func(msg string) string { return strings.Replace(msg, "stable", "unstable", 1) }},
+		{name: "multiple hash headers", text: release, content: release,
+			hashes: []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA512},
+			edit: func(msg string) string {
+				return strings.Replace(msg, "Hash: SHA256\n", "Hash: SHA1\nHash: SHA256, SHA512\n", 1)
+			}},
+		{name: "hash not listed", text: release, err: "not listed in the Hash armor header",
+			edit: func(msg string) string { return strings.Replace(msg, "Hash: SHA256\n", "Hash: SHA512\n", 1) }},
+		{name: "unknown hash", text: release, err: "unknown hash",
+			edit: func(msg string) string { return strings.Replace(msg, "Hash: SHA256\n", "Hash: WHIRLPOOL\n", 1) }},
+		{name: "other armor header", text: release, err: "unexpected armor header",
+			edit: func(msg string) string {
+				return strings.Replace(msg, "Hash: SHA256\n", "Hash: SHA256\nComment: x\n", 1)
+			}},
+		{name: "no signature", text: release, err: "Missing signature block",
+			edit: func(msg string) string { return msg[:strings.Index(msg, "-----BEGIN PGP SIGNATURE-----")] }},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, keyring := clearsignText(t, tt.text)
+			if tt.edit != nil {
+				msg = tt.edit(msg)
+			}
+			name := filepath.Join(dir, "InRelease")
+			if err := os.WriteFile(name, []byte(msg), 0644); err != nil {
+				t.Fatal(err)
+			}
+			sf, err := readCleartext(name, keyring)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sf.content != tt.content {
+				t.Errorf("content %q, want %q", sf.content, tt.content)
+			}
+			if tt.hashes != nil && !reflect.DeepEqual(sf.hashes, tt.hashes) {
+				t.Errorf("hashes %v, want %v", sf.hashes, tt.hashes)
+			}
+		})
+	}
+}
+
+// testEntity makes a key created at created, expiring after lifetime seconds
+// unless it is 0.
+func testEntity(t *testing.T, created time.Time, lifetime uint32) (*openpgp.Entity, *packet.Config) {
+	t.Helper()
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA, KeyLifetimeSecs: lifetime,
+		Time: func() time.Time { return created }}
+	e, err := openpgp.NewEntity("Test Archive", "", "test@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, config
+}
+
+func TestKeyValidAt(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	created := now.Add(-2 * time.Hour)
+	revoked := now.Add(-time.Hour)
+
+	primary := func(e *openpgp.Entity) openpgp.Key {
+		sig, _ := e.PrimarySelfSignature()
+		return openpgp.Key{Entity: e, PublicKey: e.PrimaryKey, SelfSignature: sig, Revocations: e.Revocations}
+	}
+	subkey := func(e *openpgp.Entity, sk *openpgp.Subkey) openpgp.Key {
+		return openpgp.Key{Entity: e, PublicKey: sk.PublicKey, SelfSignature: sk.Sig, Revocations: sk.Revocations}
+	}
+	// revoke revokes the primary key, or the last subkey, at revoked
+	revoke := func(t *testing.T, e *openpgp.Entity, config *packet.Config, sub bool, reason packet.ReasonForRevocation) {
+		config.Time = func() time.Time { return revoked }
+		var err error
+		if sub {
+			err = e.RevokeSubkey(&e.Subkeys[len(e.Subkeys)-1], reason, "test", config)
+		} else {
+			err = e.RevokeKey(reason, "test", config)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	signingSubkey := func(t *testing.T, e *openpgp.Entity, config *packet.Config) {
+		if err := e.AddSigningSubkey(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		lifetime uint32
+		setup    func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key
+		at       time.Time
+		err      string
+	}{
+		{name: "valid", at: now},
+		{name: "predates key", at: created.Add(-time.Minute), err: "predates"},
+		{name: "before expiry", lifetime: 3600, at: created.Add(30 * time.Minute)},
+		{name: "expired", lifetime: 3600, at: now, err: "expired"},
+		{name: "compromised", at: created.Add(time.Minute), err: "has been revoked",
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				revoke(t, e, config, false, packet.KeyCompromised)
+				return primary(e)
+			}},
+		{name: "signed before superseded", at: revoked.Add(-time.Minute),
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				revoke(t, e, config, false, packet.KeySuperseded)
+				return primary(e)
+			}},
+		{name: "signed after superseded", at: revoked.Add(time.Minute), err: "has been revoked",
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				revoke(t, e, config, false, packet.KeySuperseded)
+				return primary(e)
+			}},
+		{name: "signed before retired", at: revoked.Add(-time.Minute),
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				revoke(t, e, config, false, packet.KeyRetired)
+				return primary(e)
+			}},
+		{name: "signing subkey", at: now,
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				signingSubkey(t, e, config)
+				return subkey(e, &e.Subkeys[len(e.Subkeys)-1])
+			}},
+		{name: "subkey compromised", at: now, err: "subkey",
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				signingSubkey(t, e, config)
+				revoke(t, e, config, true, packet.KeyCompromised)
+				return subkey(e, &e.Subkeys[len(e.Subkeys)-1])
+			}},
+		{name: "subkey of revoked key", at: now, err: "has been revoked",
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				signingSubkey(t, e, config)
+				revoke(t, e, config, false, packet.KeyCompromised)
+				return subkey(e, &e.Subkeys[len(e.Subkeys)-1])
+			}},
+		{name: "subkey expired", at: now, err: "expired",
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				config.KeyLifetimeSecs = 1800
+				signingSubkey(t, e, config)
+				return subkey(e, &e.Subkeys[len(e.Subkeys)-1])
+			}},
+		{name: "encryption subkey", at: now, err: "not a signing key",
+			setup: func(t *testing.T, e *openpgp.Entity, config *packet.Config) openpgp.Key {
+				return subkey(e, &e.Subkeys[0])
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, config := testEntity(t, created, tt.lifetime)
+			key := primary(e)
+			if tt.setup != nil {
+				key = tt.setup(t, e, config)
+			}
+			err := keyValidAt(key, tt.at)
+			if tt.err == "" && err != nil {
+				t.Error(err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -15,17 +15,8 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
-	"fmt"
-	"io"
-	"log"
-	"os"
 	"strconv"
-	"strings"
 	"sync"
-
-	"github.com/ulikunitz/xz"
 )
 
 type sum_passback struct {
@@ -36,104 +27,22 @@ type sum_passback struct {
 }
 
 func sum(name string, pb *sum_passback) {
-
-	var zr io.Reader
-
-	if strings.HasPrefix(name, "http") {
-		resp, err := client.Get(name)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer resp.Body.Close()
-
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			defer gzr.Close()
-			zr = io.Reader(gzr)
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(resp.Body)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			//defer xzr.Close()
-			defer func() { xzr = nil }()
-			zr = io.Reader(xzr)
-		} else {
-			zr = resp.Body
-		}
-
-	} else {
-
-		file, err := os.OpenFile(name, os.O_RDONLY, 0666)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		defer file.Close()
-
-		if strings.HasSuffix(name, ".gz") {
-			gzr, err := gzip.NewReader(file)
-			if err != nil {
-				log.Println(err)
-				return
+	err := loadIndex(name, func(f indexFile) {
+		fsize, ok := pb.file_sizes[f.Filename]
+		if ok {
+			if f.Size != fsize {
+				out.Println("Warning", f.Filename, "has two different sizes,", fsize, "and", f.Size)
 			}
-			defer gzr.Close()
-			zr = io.Reader(gzr)
-		} else if strings.HasSuffix(name, ".xz") {
-			xzr, err := xz.NewReader(file)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			//defer xzr.Close()
-			defer func() { xzr = nil }()
-			zr = io.Reader(xzr)
-		} else {
-			zr = file
-		}
-	}
-
-	scanner := bufio.NewScanner(zr)
-	var line, filename, size string
-	for {
-		if scanner.Scan() {
-			line = scanner.Text()
 		} else {
-			break
-		}
-		parts := strings.SplitN(line, ": ", 2)
-		val := ""
-		if len(parts) == 2 {
-			val = strings.TrimSpace(parts[1])
-		}
-		switch parts[0] {
-		case "Filename":
-			filename = val
-		case "Size":
-			size = val
-		case "":
-			if filename != "" {
-				fsize, ok := pb.file_sizes[filename]
-				if ok {
-					if size != fsize {
-						fmt.Println("Warning", filename, "has two different sizes,", fsize, "and", size)
-					}
-				} else {
-					val, err := strconv.ParseUint(size, 10, 64)
-					if err == nil {
-						pb.file_sizes[filename] = size
-						pb.total = pb.total + val
-						pb.count++
-					}
-				}
+			val, err := strconv.ParseUint(f.Size, 10, 64)
+			if err == nil {
+				pb.file_sizes[f.Filename] = f.Size
+				pb.total = pb.total + val
+				pb.count++
 			}
-			filename, size = "", ""
-			continue
 		}
+	})
+	if err != nil {
+		out.Error(name, err)
 	}
 }
@@ -0,0 +1,34 @@
+// Copyright 2021 Paul Schou
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileIdentity is not available on this platform, so only the size and mtime
+// are used to notice a changed file.
+func fileIdentity(fi os.FileInfo) (inode uint64, ctime time.Time, ok bool) {
+	return
+}
+
+// lockFile is a no-op on this platform.
+func lockFile(f *os.File) error {
+	return nil
+}